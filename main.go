@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
@@ -33,51 +40,413 @@ func buildConfig(configFileName string) *speedtest.Config {
 	return config
 }
 
-func runTest(client *speedtest.Client, reporter *speedtest.Reporter, duration time.Duration) {
-	result := client.SpeedTest(duration)
-	die(result.Err)
+// interruptContext returns a context that is canceled on SIGINT or SIGTERM.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Print("Received ", sig, ", shutting down")
+		cancel()
+	}()
+	return ctx
+}
+
+// runTest runs a test of schedule's phases with client, which uses the named
+// profile, and reports it. If budget isn't nil, the test is skipped or
+// downgraded as it allows, and its data counted against it.
+func runTest(ctx context.Context, client *speedtest.Client, reporter *speedtest.Reporter, duration time.Duration, budget *speedtest.Budget, schedule speedtest.Schedule, profile string) {
+	phases := schedule.Phases
+	if len(phases) == 0 {
+		phases = client.Phases()
+	}
+	transfers := speedtest.TransfersIn(phases)
 
-	log.Println(result)
+	mode := speedtest.BudgetFull
+	if budget != nil {
+		mode = budget.Mode(time.Now(), profile, transfers)
+	}
+	if mode == speedtest.BudgetPing {
+		phases = speedtest.WithoutTransfers(phases)
+		if len(phases) == 0 {
+			mode = speedtest.BudgetSkip
+		}
+	}
+	switch mode {
+	case speedtest.BudgetSkip:
+		log.Print("Skipping test of ", client.Host(), ": the data budget is used up")
+		die(errors.Wrap(reporter.ReportBudget(budget, time.Now(), mode), "DataDog error"))
+		return
+	case speedtest.BudgetPing:
+		log.Print("Running a ping-only test of ", client.Host(), ": a full test would exceed the data budget")
+	}
 
+	result := client.RunContext(ctx, duration, phases)
+	if schedule.Name != "" {
+		result.Tags = append(result.Tags, "speedtest.schedule:"+schedule.Name)
+	}
+	if result.Err == speedtest.ErrDeferred {
+		log.Print("Deferring test of ", client.Host(), ": ", result.CrossTraffic.Before, " of background traffic on ", result.CrossTraffic.Interface)
+		die(errors.Wrap(reporter.ReportDeferred(result), "DataDog error"))
+		return
+	}
+	if budget != nil {
+		now := time.Now()
+		full := mode == speedtest.BudgetFull && transfers
+		die(errors.Wrap(budget.Add(now, profile, result.Bytes, full), "Failed to save data budget"))
+		die(errors.Wrap(reporter.ReportBudget(budget, now, mode), "DataDog error"))
+	}
+
+	if result.Err == speedtest.ErrCanceled {
+		return
+	}
+
+	// failed phases are only logged, so that one flaky phase doesn't stop
+	// every schedule.
+	if result.Err == nil {
+		log.Println(result)
+	}
+	for _, phase := range result.Phases {
+		if err := result.Errors[phase]; err != nil {
+			log.Printf("[ERROR] Test of %s: %s", client.Host(), err)
+		}
+	}
+	if result.Traceroute != nil {
+		log.Println(result.Traceroute)
+	}
+
+	// the phases that succeeded are still reported when others failed.
 	err := reporter.Report(result)
 	die(errors.Wrap(err, "DataDog error"))
 }
 
+// profile is the clients and reporters of a test profile, or of the
+// configuration itself if name is empty.
+type profile struct {
+	name      string
+	clients   []*speedtest.Client
+	reporters []*speedtest.Reporter
+	duration  time.Duration
+}
+
+// newProfile creates the clients and reporters of the named profile of config.
+// duration is used unless the profile sets its own.
+func newProfile(ctx context.Context, config *speedtest.Config, name string, dog *statsd.Client, tcpInfo bool, duration time.Duration) (*profile, error) {
+	profiled, err := config.Profile(name)
+	if err != nil {
+		return nil, err
+	}
+	if p := config.Profiles[name]; p != nil && p.Duration > 0 {
+		duration = time.Duration(p.Duration)
+	}
+	clients, err := speedtest.NewClientsContext(ctx, profiled)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &profile{name: name, clients: clients, duration: duration}
+	for _, sc := range clients {
+		tags := []string{"speedtest.server:" + sc.Host()}
+		if name != "" {
+			tags = append(tags, "speedtest.profile:"+name)
+		}
+		p.reporters = append(p.reporters, &speedtest.Reporter{
+			Client:  dog,
+			Tags:    tags,
+			TCPInfo: tcpInfo,
+		})
+	}
+	return p, nil
+}
+
+// runTests runs a test of schedule with each of profile's clients in turn.
+func runTests(ctx context.Context, profile *profile, budget *speedtest.Budget, schedule speedtest.Schedule) {
+	for i, sc := range profile.clients {
+		if ctx.Err() != nil {
+			return
+		}
+		runTest(ctx, sc, profile.reporters[i], profile.duration, budget, schedule, profile.name)
+	}
+}
+
+// dueTest is a test that a schedule has come due for, with the name of the
+// profile it uses.
+type dueTest struct {
+	schedule speedtest.Schedule
+	profile  string
+}
+
+// schedule sends a test of each of schedules to due at the start and then
+// every Interval, until ctx is done, rotating through the schedule's
+// profiles. Ticks that come while due isn't being read, or outside the
+// schedule's window, are dropped, so that tests don't pile up behind a slow
+// one.
+func schedule(ctx context.Context, schedules []speedtest.Schedule, due chan<- dueTest) {
+	for _, s := range schedules {
+		go func(s speedtest.Schedule) {
+			ticker := time.NewTicker(time.Duration(s.Interval))
+			defer ticker.Stop()
+			for n := 0; ; {
+				if s.Active(time.Now()) {
+					select {
+					case due <- dueTest{schedule: s, profile: s.Profile(n)}:
+						n++
+					case <-ctx.Done():
+						return
+					}
+				}
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(s)
+	}
+}
+
+// scheduleFlags collects -schedule flags, each of which is
+// name:interval:phases, such as ping:30s:ping, optionally followed by
+// :profiles, the comma-separated profiles it rotates through.
+type scheduleFlags []speedtest.Schedule
+
+func (f *scheduleFlags) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *scheduleFlags) Set(value string) error {
+	parts := strings.SplitN(value, ":", 4)
+	if len(parts) < 3 {
+		return fmt.Errorf("expected name:interval:phases[:profiles], got %q", value)
+	}
+	interval, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return err
+	}
+	phases, err := speedtest.ParsePhases(parts[2])
+	if err != nil {
+		return err
+	}
+	s := speedtest.Schedule{Name: parts[0], Interval: speedtest.Duration(interval), Phases: phases}
+	if len(parts) == 4 {
+		for _, name := range strings.Split(parts[3], ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				s.Profiles = append(s.Profiles, name)
+			}
+		}
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+// serve runs speedtestdog as a speedtest server until interrupted.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", ":8080", "the address to serve the speedtest protocol on, or empty to disable it")
+	httpListen := flags.String("httpListen", "", "the address to serve LibreSpeed-compatible HTTP endpoints on, or empty to disable them")
+	udpListen := flags.String("udpListen", "", "the address to answer UDP probes on, or empty to disable it")
+	maxConns := flags.Int("maxConns", 0, "the maximum number of connections to serve at once, or 0 for no limit")
+	rateLimit := flags.Uint64("rateLimit", 0, "the maximum throughput of each client in bits/sec, or 0 for no limit")
+	flags.Parse(args)
+
+	if *listen == "" && *httpListen == "" && *udpListen == "" {
+		die(errors.New("nothing to serve: -listen, -httpListen and -udpListen are all empty"))
+	}
+
+	ctx := interruptContext()
+	errs := make(chan error, 3)
+	servers := 0
+
+	if *listen != "" {
+		server := &speedtest.Server{
+			Addr:      *listen,
+			MaxConns:  *maxConns,
+			RateLimit: speedtest.Speed(*rateLimit),
+		}
+		log.Print("Serving speedtests on ", *listen)
+		servers++
+		go func() { errs <- server.ListenAndServe(ctx) }()
+	}
+
+	if *httpListen != "" {
+		server := &http.Server{Addr: *httpListen, Handler: speedtest.NewLibreSpeedHandler()}
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		log.Print("Serving LibreSpeed endpoints on ", *httpListen)
+		servers++
+		go func() {
+			err := server.ListenAndServe()
+			if err == http.ErrServerClosed {
+				err = nil
+			}
+			errs <- err
+		}()
+	}
+
+	if *udpListen != "" {
+		server := &speedtest.UDPServer{Addr: *udpListen}
+		log.Print("Answering UDP probes on ", *udpListen)
+		servers++
+		go func() { errs <- server.ListenAndServe(ctx) }()
+	}
+
+	for ; servers > 0; servers-- {
+		die(<-errs)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
+
 	configFileName := flag.String("configFile", "speedtestdog.json", "the speedtest configuration json file")
 	statsdAddress := flag.String("statsdAddress", "localhost:8125", "the address of the DataDog agent")
 	wifiName := flag.String("wifiName", wifiname.WifiName(), "the name of your network")
 	pollDelay := flag.Duration("poll", 30*time.Second, "The wait time between successive speed tests")
 	duration := flag.Duration("duration", 1*time.Second, "The length of each speed test")
+	server := flag.String("server", "", "the host:port of a speedtest server to use instead of the closest speedtest.net server")
+	source := flag.String("source", "", "the local IP address to run speed tests from")
+	iface := flag.String("interface", "", "the network interface to run speed tests over (Linux only)")
+	tcpInfo := flag.Bool("tcpInfo", false, "also report the kernel's TCP_INFO for each download and upload connection (Linux only)")
+	proxy := flag.String("proxy", "", "a socks5:// or http:// proxy URL to run speed tests through")
+	phases := flag.String("phases", "", "the comma-separated phases each test runs, such as download,upload,ping (default all)")
+	profileName := flag.String("profile", "", "the configured profile to test with instead of the configuration itself, every -poll or on each schedule that doesn't name its own profiles")
+	var schedules scheduleFlags
+	flag.Var(&schedules, "schedule", "a name:interval:phases[:profiles] schedule, such as ping:30s:ping or nightly:24h::quick,thorough, to run instead of -phases every -poll; may be repeated")
 	flag.Parse()
 
+	if *duration <= 0 {
+		log.Fatalf("[ERROR] -duration must be positive, got %s", *duration)
+	}
+
 	config := buildConfig(*configFileName)
-	log.Printf("Config: %#v", *config)
+	if *server != "" {
+		config.Server = *server
+	}
+	if *source != "" {
+		config.SourceAddress = *source
+	}
+	if *iface != "" {
+		config.Interface = *iface
+	}
+	if *proxy != "" {
+		config.Proxy = *proxy
+	}
+	if *phases != "" {
+		parsed, err := speedtest.ParsePhases(*phases)
+		die(errors.Wrap(err, "Invalid -phases"))
+		config.Phases = parsed
+	}
+	if len(schedules) > 0 {
+		config.Schedules = schedules
+	}
+	for _, s := range config.Schedules {
+		if s.Interval <= 0 {
+			log.Fatalf("[ERROR] schedule %q needs a positive interval", s.Name)
+		}
+	}
+	logged := *config
+	if u, err := url.Parse(config.Proxy); err == nil && config.Proxy != "" {
+		logged.Proxy = u.Redacted()
+	}
+	log.Printf("Config: %#v", logged)
 
-	sc, err := speedtest.NewClient(config)
-	die(err)
+	ctx := interruptContext()
+
+	active := append([]speedtest.Schedule(nil), config.Schedules...)
+	if len(active) == 0 {
+		active = []speedtest.Schedule{{Interval: speedtest.Duration(*pollDelay)}}
+	}
+	if *profileName != "" {
+		for i := range active {
+			if len(active[i].Profiles) == 0 {
+				active[i].Profiles = []string{*profileName}
+			}
+		}
+	}
+	for _, s := range active {
+		for _, name := range s.Profiles {
+			if _, ok := config.Profiles[name]; !ok {
+				log.Fatalf("[ERROR] unknown profile %q", name)
+			}
+		}
+	}
+
+	var budget *speedtest.Budget
+	var err error
+	if config.Budget != nil {
+		budget, err = speedtest.OpenBudget(config.Budget)
+		die(errors.Wrap(err, "Failed to open data budget"))
+	}
 
 	dog, err := statsd.New(*statsdAddress)
 	die(err)
 
 	dog.Namespace = "speedtest."
+	backend := config.Backend
+	if backend == "" {
+		backend = "tcp"
+	}
 	dog.Tags = append(dog.Tags,
-		"speedtest.server:"+sc.Host(),
 		"speedtest.wifi_name:"+*wifiName,
+		"speedtest.backend:"+backend,
 	)
 
 	log.Print("Monitoring network ", *wifiName)
-	log.Print("Polling server ", sc.Host(), " in ", sc.Location(), " every ", pollDelay, ".")
-	log.Print("Each test will run for ", int(duration.Seconds()), "s")
+	profiles := make(map[string]*profile)
+	for _, s := range active {
+		names := s.Profiles
+		if len(names) == 0 {
+			names = []string{""}
+		}
+		for _, name := range names {
+			if profiles[name] != nil {
+				continue
+			}
+			p, err := newProfile(ctx, config, name, dog, *tcpInfo, *duration)
+			if err == speedtest.ErrCanceled {
+				return
+			}
+			die(err)
+			profiles[name] = p
+
+			prefix := ""
+			if name != "" {
+				prefix = "Profile " + name + ": "
+			}
+			for _, sc := range p.clients {
+				log.Print(prefix, "Polling server ", sc.Host(), " in ", sc.Location(), ".")
+			}
+			log.Print(prefix, "Each test will run for ", p.duration)
+		}
+
+		phases := s.Phases
+		if len(phases) == 0 {
+			phases = profiles[names[0]].clients[0].Phases()
+		}
+		if len(s.Profiles) > 0 {
+			log.Print("Running ", phases, " every ", time.Duration(s.Interval), " with profiles ", s.Profiles, ".")
+		} else {
+			log.Print("Running ", phases, " every ", time.Duration(s.Interval), ".")
+		}
+	}
 
 	err = dog.Incr("boot", nil, 1)
 	die(err)
 
-	reporter := &speedtest.Reporter{Client: dog}
-	ticks := time.NewTicker(*pollDelay).C
-
-	runTest(sc, reporter, *duration)
-	for range ticks {
-		runTest(sc, reporter, *duration)
+	due := make(chan dueTest)
+	schedule(ctx, active, due)
+	for {
+		select {
+		case t := <-due:
+			runTests(ctx, profiles[t.profile], budget, t.schedule)
+		case <-ctx.Done():
+			return
+		}
 	}
 }
@@ -0,0 +1,64 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+// Backend is a measurement protocol that a Client drives to run speed tests
+// against a single server. Latency may be called while Download or Upload is
+// running, but otherwise implementations do not need to be safe for concurrent
+// use. Every method should give up promptly once its context is done.
+type Backend interface {
+	// Download measures downstream bandwidth as described by opts.
+	Download(ctx context.Context, opts TransferOptions) (*Transfer, error)
+
+	// Upload measures upstream bandwidth as described by opts.
+	Upload(ctx context.Context, opts TransferOptions) (*Transfer, error)
+
+	// Latency sends up to count round trip probes to the server, interval
+	// apart, stopping early without error once ctx is done. A count of zero
+	// keeps probing until ctx is done. It returns the round trip time of every
+	// probe that was answered, in order, and the number of probes that timed
+	// out.
+	Latency(ctx context.Context, count int, interval time.Duration) (samples []time.Duration, lost int, err error)
+
+	// Server describes the server the backend is testing against.
+	Server() ServerInfo
+}
+
+// ServerInfo describes the server a Backend is testing against.
+type ServerInfo struct {
+	// Host is the address of the server.
+	Host string
+
+	// Location is a human readable description of where the server is.
+	Location string
+}
+
+// backendFactory creates a Backend that tests against a speedtest.net server.
+type backendFactory func(*stdn.Testserver) (Backend, error)
+
+// newBackendFactory looks up the backendFactory for a Config.Backend, whose
+// backends make their connections with d.
+func newBackendFactory(name string, d *dialer) (backendFactory, error) {
+	switch name {
+	case "", "tcp":
+		return func(s *stdn.Testserver) (Backend, error) {
+			return &speedtestNetBackend{server: s, dial: d}, nil
+		}, nil
+	case "http":
+		return func(s *stdn.Testserver) (Backend, error) {
+			return newHTTPBackend(s, d)
+		}, nil
+	case "iperf3":
+		return func(s *stdn.Testserver) (Backend, error) {
+			return newIperf3Backend(s.Host, d), nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+}
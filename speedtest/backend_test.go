@@ -0,0 +1,257 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeBackend is a Backend that returns canned results without touching the
+// network.
+type fakeBackend struct {
+	download, upload *Transfer
+	downloadErr      error
+	uploadErr        error
+
+	samples    []time.Duration
+	lost       int
+	latencyErr error
+
+	// loadedErr fails the latency probes that run alongside transfers.
+	loadedErr error
+
+	// calls records the methods called, in order.
+	calls []string
+}
+
+func (b *fakeBackend) Download(ctx context.Context, opts TransferOptions) (*Transfer, error) {
+	b.calls = append(b.calls, "download")
+	return b.transfer(ctx, b.download, b.downloadErr)
+}
+
+func (b *fakeBackend) Upload(ctx context.Context, opts TransferOptions) (*Transfer, error) {
+	b.calls = append(b.calls, "upload")
+	return b.transfer(ctx, b.upload, b.uploadErr)
+}
+
+func (b *fakeBackend) transfer(ctx context.Context, t *Transfer, err error) (*Transfer, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (b *fakeBackend) Latency(ctx context.Context, count int, interval time.Duration) ([]time.Duration, int, error) {
+	if count == 0 {
+		// a probe under load, which runs until ctx is done.
+		if b.loadedErr != nil {
+			return nil, 0, b.loadedErr
+		}
+		return []time.Duration{30 * time.Millisecond, 50 * time.Millisecond}, 0, nil
+	}
+	b.calls = append(b.calls, "latency")
+	if b.latencyErr != nil {
+		return nil, 0, b.latencyErr
+	}
+	return b.samples, b.lost, nil
+}
+
+func (b *fakeBackend) Server() ServerInfo {
+	return ServerInfo{Host: "fake:8080", Location: "Nowhere"}
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		download: &Transfer{Speed: 100e6, Bytes: 12500000},
+		upload:   &Transfer{Speed: 20e6, Bytes: 2500000},
+		samples:  []time.Duration{10 * time.Millisecond, 12 * time.Millisecond, 11 * time.Millisecond},
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	failed := errors.New("boom")
+	all := []Phase{PhaseDownload, PhaseUpload, PhasePing}
+
+	tests := []struct {
+		name    string
+		phases  []Phase
+		setup   func(*fakeBackend)
+		calls   []string
+		ran     []Phase
+		failed  []Phase
+		err     string
+		dlSpeed Speed
+		ulSpeed Speed
+		ping    time.Duration
+	}{
+		{
+			name:    "all succeed",
+			phases:  all,
+			calls:   []string{"download", "upload", "latency"},
+			ran:     all,
+			dlSpeed: 100e6,
+			ulSpeed: 20e6,
+			ping:    11 * time.Millisecond,
+		},
+		{
+			name:    "failed download doesn't stop the rest",
+			phases:  all,
+			setup:   func(b *fakeBackend) { b.downloadErr = failed },
+			calls:   []string{"download", "upload", "latency"},
+			ran:     all,
+			failed:  []Phase{PhaseDownload},
+			err:     "Error getting download: boom",
+			ulSpeed: 20e6,
+			ping:    11 * time.Millisecond,
+		},
+		{
+			name:   "failed upload and ping",
+			phases: all,
+			setup: func(b *fakeBackend) {
+				b.uploadErr = failed
+				b.latencyErr = failed
+			},
+			calls:   []string{"download", "upload", "latency"},
+			ran:     all,
+			failed:  []Phase{PhaseUpload, PhasePing},
+			err:     "Error getting upload: boom",
+			dlSpeed: 100e6,
+		},
+		{
+			name:   "every ping lost",
+			phases: []Phase{PhasePing},
+			setup: func(b *fakeBackend) {
+				b.samples = nil
+				b.lost = 3
+			},
+			calls:  []string{"latency"},
+			ran:    []Phase{PhasePing},
+			failed: []Phase{PhasePing},
+			err:    "Error getting ping: all 3 probes timed out",
+		},
+		{
+			name:    "only the given phases run, in order",
+			phases:  []Phase{PhasePing, PhaseUpload},
+			calls:   []string{"upload", "latency"},
+			ran:     []Phase{PhaseUpload, PhasePing},
+			ulSpeed: 20e6,
+			ping:    11 * time.Millisecond,
+		},
+		{
+			name:   "unconfigured probes don't run",
+			phases: []Phase{PhaseUDP, PhaseDNS, PhaseHTTP, PhaseICMP, PhasePathMTU},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newFakeBackend()
+			if test.setup != nil {
+				test.setup(backend)
+			}
+			c := NewBackendClient(&Config{}, backend)
+			result := c.RunContext(context.Background(), time.Second, test.phases)
+
+			if !reflect.DeepEqual(backend.calls, test.calls) {
+				t.Errorf("calls = %v, want %v", backend.calls, test.calls)
+			}
+			if !reflect.DeepEqual(result.Phases, test.ran) {
+				t.Errorf("Phases = %v, want %v", result.Phases, test.ran)
+			}
+			for _, phase := range AllPhases {
+				want := false
+				for _, f := range test.failed {
+					want = want || f == phase
+				}
+				if got := result.Errors[phase] != nil; got != want {
+					t.Errorf("Errors[%s] = %v, want failure %v", phase, result.Errors[phase], want)
+				}
+			}
+			if test.err == "" && result.Err != nil {
+				t.Errorf("Err = %v, want nil", result.Err)
+			}
+			if test.err != "" && (result.Err == nil || result.Err.Error() != test.err) {
+				t.Errorf("Err = %v, want %q", result.Err, test.err)
+			}
+			if result.DownloadSpeed != test.dlSpeed {
+				t.Errorf("DownloadSpeed = %d, want %d", result.DownloadSpeed, test.dlSpeed)
+			}
+			if result.UploadSpeed != test.ulSpeed {
+				t.Errorf("UploadSpeed = %d, want %d", result.UploadSpeed, test.ulSpeed)
+			}
+			if result.Ping != test.ping {
+				t.Errorf("Ping = %s, want %s", result.Ping, test.ping)
+			}
+		})
+	}
+}
+
+func TestRunContextCanceled(t *testing.T) {
+	backend := newFakeBackend()
+	c := NewBackendClient(&Config{}, backend)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result := c.RunContext(ctx, time.Second, AllPhases)
+	if result.Err != ErrCanceled {
+		t.Errorf("Err = %v, want ErrCanceled", result.Err)
+	}
+	if want := []string{"download"}; !reflect.DeepEqual(backend.calls, want) {
+		t.Errorf("calls = %v, want %v", backend.calls, want)
+	}
+	if len(result.Errors) != 0 {
+		t.Errorf("Errors = %v, want none for a canceled test", result.Errors)
+	}
+}
+
+func TestRunContextZeroDurationSkipsTransfers(t *testing.T) {
+	backend := newFakeBackend()
+	c := NewBackendClient(&Config{}, backend)
+
+	result := c.RunContext(context.Background(), 0, AllPhases)
+	if want := []Phase{PhasePing}; !reflect.DeepEqual(result.Phases, want) {
+		t.Errorf("Phases = %v, want %v", result.Phases, want)
+	}
+	if result.Ran(PhaseDownload) || result.Ran(PhaseUpload) {
+		t.Errorf("transfers ran with a zero duration")
+	}
+}
+
+func TestRunContextLoadedLatency(t *testing.T) {
+	tests := []struct {
+		name      string
+		loadedErr error
+		grade     string
+	}{
+		{name: "graded", grade: "B"},
+		{name: "failed probe keeps the transfers", loadedErr: errors.New("server busy")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newFakeBackend()
+			backend.loadedErr = test.loadedErr
+			c := NewBackendClient(&Config{LoadedLatency: true}, backend)
+			result := c.RunContext(context.Background(), time.Second, []Phase{PhaseDownload, PhaseUpload, PhasePing})
+
+			if result.Err != nil {
+				t.Fatalf("Err = %v, want nil", result.Err)
+			}
+			if result.DownloadSpeed != 100e6 || result.UploadSpeed != 20e6 {
+				t.Errorf("speeds = %d, %d, want the transfers' own", result.DownloadSpeed, result.UploadSpeed)
+			}
+			if result.BufferbloatGrade != test.grade {
+				t.Errorf("BufferbloatGrade = %q, want %q", result.BufferbloatGrade, test.grade)
+			}
+			if loaded := len(result.DownloadLatency.Samples) > 0; loaded != (test.loadedErr == nil) {
+				t.Errorf("DownloadLatency = %+v, want samples only if the probe succeeded", result.DownloadLatency)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package speedtest
+
+import (
+	"os"
+	"syscall"
+)
+
+// bindToDevice restricts the socket fd to sending and receiving over iface.
+func bindToDevice(fd int, iface string) error {
+	return os.NewSyscallError("setsockopt", syscall.BindToDevice(fd, iface))
+}
+
+// bindFD applies the dialer's source address and interface to a socket the
+// net package didn't create.
+func (d *dialer) bindFD(fd int, v6 bool) error {
+	if d.iface != "" {
+		if err := bindToDevice(fd, d.iface); err != nil {
+			return err
+		}
+	}
+	if d.source == nil {
+		return nil
+	}
+
+	var sa syscall.Sockaddr
+	if v6 {
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], d.source.To16())
+		sa = sa6
+	} else {
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], d.source.To4())
+		sa = sa4
+	}
+	return os.NewSyscallError("bind", syscall.Bind(fd, sa))
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package speedtest
+
+import "fmt"
+
+func bindToDevice(fd int, iface string) error {
+	return fmt.Errorf("binding to an interface is only supported on Linux")
+}
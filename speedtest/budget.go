@@ -0,0 +1,210 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultBudgetStateFile is where a Budget's running totals are kept if
+// BudgetConfig.StateFile is empty.
+const defaultBudgetStateFile = "speedtestdog_budget.json"
+
+// BudgetConfig caps the data speed tests use, for metered links. Once a test
+// would take usage over a cap, tests are skipped or downgraded until the day or
+// month is over.
+type BudgetConfig struct {
+	// Daily and Monthly are the most bytes tests may use in a calendar day or
+	// month of local time. Zero means no cap.
+	Daily   uint64 `json:"daily,omitempty"`
+	Monthly uint64 `json:"monthly,omitempty"`
+
+	// Downgrade, if set, runs ping-only tests, which skip the download and
+	// upload, instead of skipping tests entirely once a full test no longer
+	// fits in the budget.
+	Downgrade bool `json:"downgrade,omitempty"`
+
+	// StateFile is where the running totals are kept across restarts. Empty
+	// means defaultBudgetStateFile.
+	StateFile string `json:"stateFile,omitempty"`
+}
+
+// BudgetMode is how much of a test a Budget allows.
+type BudgetMode string
+
+const (
+	// BudgetFull allows a full test.
+	BudgetFull BudgetMode = "full"
+
+	// BudgetPing allows a ping-only test.
+	BudgetPing BudgetMode = "ping"
+
+	// BudgetSkip allows no test at all.
+	BudgetSkip BudgetMode = "skip"
+)
+
+// Budget keeps the running totals of data used by tests against a
+// BudgetConfig's caps. It is safe for concurrent use.
+type Budget struct {
+	config *BudgetConfig
+	path   string
+
+	mu    sync.Mutex
+	state budgetState
+}
+
+// budgetState is what a Budget persists to its state file.
+type budgetState struct {
+	// Day and Month are the local date, as 2006-01-02 and 2006-01, the totals
+	// were last added to.
+	Day        string `json:"day"`
+	DayBytes   uint64 `json:"dayBytes"`
+	Month      string `json:"month"`
+	MonthBytes uint64 `json:"monthBytes"`
+
+	// LastFull is the data used by the most recent full test of each
+	// profile, keyed by its name or empty for the Config itself, which is
+	// taken as the cost of the profile's next one.
+	LastFull map[string]uint64 `json:"lastFull"`
+}
+
+// OpenBudget creates a Budget for config, picking up the running totals from
+// its state file if there is one.
+func OpenBudget(config *BudgetConfig) (*Budget, error) {
+	b := &Budget{config: config, path: config.StateFile}
+	if b.path == "" {
+		b.path = defaultBudgetStateFile
+	}
+
+	data, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.state); err != nil {
+		return nil, fmt.Errorf("invalid budget state file %s: %s", b.path, err)
+	}
+	return b, nil
+}
+
+// Mode is how much of a test with the named profile the budget allows at now.
+// transfers is whether the test downloads or uploads, without which it is
+// cheap enough to run whenever any budget is left.
+func (b *Budget) Mode(now time.Time, profile string, transfers bool) BudgetMode {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(now)
+
+	remaining, capped := b.remaining()
+	if !capped {
+		return BudgetFull
+	}
+	if remaining > 0 && (!transfers || remaining >= b.state.LastFull[profile]) {
+		return BudgetFull
+	}
+	if b.config.Downgrade && remaining > 0 {
+		return BudgetPing
+	}
+	return BudgetSkip
+}
+
+// Add counts bytes used by a test with the named profile at now against the
+// budget, and saves the new totals. full is whether it was a full test rather
+// than a ping-only one.
+func (b *Budget) Add(now time.Time, profile string, bytes uint64, full bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(now)
+
+	b.state.DayBytes += bytes
+	b.state.MonthBytes += bytes
+	if full {
+		if b.state.LastFull == nil {
+			b.state.LastFull = make(map[string]uint64)
+		}
+		b.state.LastFull[profile] = bytes
+	}
+	return b.save()
+}
+
+// Usage returns the bytes used so far in the day and month of now.
+func (b *Budget) Usage(now time.Time) (day, month uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(now)
+	return b.state.DayBytes, b.state.MonthBytes
+}
+
+// Config returns the BudgetConfig b enforces.
+func (b *Budget) Config() *BudgetConfig {
+	return b.config
+}
+
+// roll starts new totals if now is in a later day or month than the current
+// ones. b.mu must be held.
+func (b *Budget) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); day != b.state.Day {
+		b.state.Day = day
+		b.state.DayBytes = 0
+	}
+	if month := now.Format("2006-01"); month != b.state.Month {
+		b.state.Month = month
+		b.state.MonthBytes = 0
+	}
+}
+
+// remaining returns the bytes left under the tightest cap, and whether there
+// is a cap at all. b.mu must be held.
+func (b *Budget) remaining() (uint64, bool) {
+	var remaining uint64
+	capped := false
+	left := func(limit, used uint64) {
+		if limit == 0 {
+			return
+		}
+		var r uint64
+		if used < limit {
+			r = limit - used
+		}
+		if !capped || r < remaining {
+			remaining = r
+		}
+		capped = true
+	}
+	left(b.config.Daily, b.state.DayBytes)
+	left(b.config.Monthly, b.state.MonthBytes)
+	return remaining, capped
+}
+
+// save writes the totals to the state file, replacing it atomically so that a
+// crash can't leave it half written. b.mu must be held.
+func (b *Budget) save() error {
+	data, err := json.Marshal(&b.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(b.path), filepath.Base(b.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package speedtest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestBudget(t *testing.T, config BudgetConfig) *Budget {
+	dir, err := ioutil.TempDir("", "budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	config.StateFile = filepath.Join(dir, "state.json")
+	b, err := OpenBudget(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func day(month time.Month, d, hour int) time.Time {
+	return time.Date(2020, month, d, hour, 0, 0, 0, time.Local)
+}
+
+func TestBudgetRollOver(t *testing.T) {
+	b := openTestBudget(t, BudgetConfig{Daily: 100, Monthly: 250})
+
+	steps := []struct {
+		now        time.Time
+		add        uint64
+		day, month uint64
+	}{
+		{now: day(1, 30, 10), add: 60, day: 60, month: 60},
+		{now: day(1, 30, 23), add: 30, day: 90, month: 90},
+		{now: day(1, 31, 0), add: 50, day: 50, month: 140},
+		{now: day(1, 31, 12), add: 0, day: 50, month: 140},
+		{now: day(2, 1, 0), add: 10, day: 10, month: 10},
+	}
+
+	for _, step := range steps {
+		if err := b.Add(step.now, "", step.add, true); err != nil {
+			t.Fatal(err)
+		}
+		if d, m := b.Usage(step.now); d != step.day || m != step.month {
+			t.Errorf("Usage(%s) = %d, %d, want %d, %d", step.now.Format("2006-01-02 15:04"), d, m, step.day, step.month)
+		}
+	}
+}
+
+func TestBudgetMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    BudgetConfig
+		used      uint64
+		now       time.Time
+		transfers bool
+		want      BudgetMode
+	}{
+		{name: "uncapped", used: 1000, now: day(3, 1, 12), transfers: true, want: BudgetFull},
+		{name: "fits", config: BudgetConfig{Daily: 100}, used: 40, now: day(3, 1, 12), transfers: true, want: BudgetFull},
+		{name: "full test doesn't fit", config: BudgetConfig{Daily: 100}, used: 60, now: day(3, 1, 12), transfers: true, want: BudgetSkip},
+		{name: "ping-only still fits", config: BudgetConfig{Daily: 100}, used: 60, now: day(3, 1, 12), want: BudgetFull},
+		{name: "downgraded", config: BudgetConfig{Daily: 100, Downgrade: true}, used: 60, now: day(3, 1, 12), transfers: true, want: BudgetPing},
+		{name: "nothing left", config: BudgetConfig{Daily: 100, Downgrade: true}, used: 200, now: day(3, 1, 12), want: BudgetSkip},
+		{name: "tightest cap wins", config: BudgetConfig{Daily: 1000, Monthly: 70}, used: 40, now: day(3, 1, 12), transfers: true, want: BudgetSkip},
+		{name: "next day", config: BudgetConfig{Daily: 100}, used: 60, now: day(3, 2, 0), transfers: true, want: BudgetFull},
+		{name: "next day, same month", config: BudgetConfig{Daily: 100, Monthly: 100}, used: 60, now: day(3, 2, 0), transfers: true, want: BudgetSkip},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := openTestBudget(t, test.config)
+			// the first full test is taken as the cost of the next.
+			if err := b.Add(day(3, 1, 8), "", test.used, true); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.Mode(test.now, "", test.transfers); got != test.want {
+				t.Errorf("Mode = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBudgetPersists(t *testing.T) {
+	b := openTestBudget(t, BudgetConfig{Daily: 100})
+	now := day(4, 1, 12)
+	if err := b.Add(now, "", 30, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(now, "", 5, false); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenBudget(b.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, m := reopened.Usage(now); d != 35 || m != 35 {
+		t.Errorf("reopened Usage = %d, %d, want 35, 35", d, m)
+	}
+	if reopened.state.LastFull[""] != 30 {
+		t.Errorf("reopened LastFull = %v, want 30", reopened.state.LastFull)
+	}
+}
+
+func TestBudgetModeByProfile(t *testing.T) {
+	b := openTestBudget(t, BudgetConfig{Daily: 1000})
+	now := day(5, 1, 12)
+	if err := b.Add(now, "thorough", 600, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(now, "quick", 50, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// 350 bytes are left, which only fit the quick profile's tests.
+	for profile, want := range map[string]BudgetMode{
+		"quick":    BudgetFull,
+		"thorough": BudgetSkip,
+	} {
+		if got := b.Mode(now, profile, true); got != want {
+			t.Errorf("Mode for %s = %s, want %s", profile, got, want)
+		}
+	}
+}
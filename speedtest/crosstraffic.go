@@ -0,0 +1,147 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultCrossTrafficSample = time.Second
+
+	// wireOverhead is roughly how much bigger a test's traffic is on the
+	// interface than the payload the dialer counts, going by the TCP/IP and
+	// Ethernet headers of full-sized segments and the ACKs coming back.
+	wireOverhead = 1.07
+)
+
+// CrossTrafficConfig configures watching the tested interface's counters for
+// traffic that isn't the test's, which skews its results and is slowed by it.
+type CrossTrafficConfig struct {
+	// Sample is how long the interface is watched before each test. Zero
+	// means defaultCrossTrafficSample.
+	Sample Duration `json:"sample,omitempty"`
+
+	// MaxBackground, if set, defers a test when the traffic before it is
+	// faster than this, in bits/sec. The test's Result then has ErrDeferred
+	// as its Err.
+	MaxBackground Speed `json:"maxBackground,omitempty"`
+}
+
+// CrossTraffic is the traffic on the tested interface that wasn't the test's.
+type CrossTraffic struct {
+	Interface string
+
+	// Before is the interface's throughput, in both directions combined, while
+	// it was watched before the test.
+	Before Speed
+
+	// During is the throughput of everything but the test's own traffic while
+	// it ran, in both directions combined. The test's traffic on the wire is
+	// estimated from its payload, so During is approximate, more so when the
+	// test moved a lot of data.
+	During Speed
+}
+
+// interfaceCounters are the bytes an interface has received and sent.
+type interfaceCounters struct {
+	rx, tx uint64
+}
+
+// since is the traffic in both directions combined between start and c. It
+// is zero if the counters were reset in between.
+func (c interfaceCounters) since(start interfaceCounters) uint64 {
+	if c.rx < start.rx || c.tx < start.tx {
+		return 0
+	}
+	return c.rx - start.rx + c.tx - start.tx
+}
+
+// testInterface is the name of the network interface the tests go over: the
+// configured one, or the one the route to the server, or the proxy, uses.
+func (c *Client) testInterface(ctx context.Context) (string, error) {
+	if c.config.Interface != "" {
+		return c.config.Interface, nil
+	}
+
+	host := c.Host()
+	if c.dial.proxy != nil {
+		host = c.dial.proxy.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+	// connecting a UDP socket picks a route without sending anything.
+	conn, err := c.dial.dialDirect(ctx, "udp", host, dialTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(local) {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no interface has address %s", local)
+}
+
+// watchCrossTraffic measures the traffic on the tested interface for the
+// configured sample period. It also returns the interface's counters at the
+// end of the period, so that the test's own period can be measured from them.
+func (c *Client) watchCrossTraffic(ctx context.Context) (*CrossTraffic, interfaceCounters, error) {
+	iface, err := c.testInterface(ctx)
+	if err != nil {
+		return nil, interfaceCounters{}, err
+	}
+	sample := time.Duration(c.config.CrossTraffic.Sample)
+	if sample <= 0 {
+		sample = defaultCrossTrafficSample
+	}
+
+	start, err := readInterfaceCounters(iface)
+	if err != nil {
+		return nil, interfaceCounters{}, err
+	}
+	began := time.Now()
+	if !wait(sample, ctx.Done()) {
+		return nil, interfaceCounters{}, ctx.Err()
+	}
+	end, err := readInterfaceCounters(iface)
+	if err != nil {
+		return nil, interfaceCounters{}, err
+	}
+
+	traffic := &CrossTraffic{
+		Interface: iface,
+		Before:    speed(end.since(start), time.Since(began)),
+	}
+	return traffic, end, nil
+}
+
+// crossTrafficDuring sets traffic.During from the interface's counters at
+// start, elapsed before now, and the payload bytes the test moved since.
+func crossTrafficDuring(traffic *CrossTraffic, start interfaceCounters, elapsed time.Duration, testBytes uint64) error {
+	end, err := readInterfaceCounters(traffic.Interface)
+	if err != nil {
+		return err
+	}
+	wire := uint64(float64(testBytes) * wireOverhead)
+	total := end.since(start)
+	if total > wire {
+		traffic.During = speed(total-wire, elapsed)
+	}
+	return nil
+}
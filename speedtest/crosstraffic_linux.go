@@ -0,0 +1,51 @@
+package speedtest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readInterfaceCounters reads iface's byte counters from /proc/net/dev.
+func readInterfaceCounters(iface string) (interfaceCounters, error) {
+	f, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return interfaceCounters{}, err
+	}
+	defer f.Close()
+	return parseInterfaceCounters(f, iface)
+}
+
+// parseInterfaceCounters finds iface's byte counters in r, which is in the
+// format of /proc/net/dev.
+func parseInterfaceCounters(r io.Reader, iface string) (interfaceCounters, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// lines look like "  eth0: rx_bytes rx_packets ... tx_bytes ...",
+		// with eight receive columns before the transmit ones.
+		colon := strings.IndexByte(scanner.Text(), ':')
+		if colon < 0 || strings.TrimSpace(scanner.Text()[:colon]) != iface {
+			continue
+		}
+		fields := strings.Fields(scanner.Text()[colon+1:])
+		if len(fields) < 9 {
+			return interfaceCounters{}, fmt.Errorf("malformed /proc/net/dev line for %s", iface)
+		}
+		rx, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return interfaceCounters{}, err
+		}
+		tx, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			return interfaceCounters{}, err
+		}
+		return interfaceCounters{rx: rx, tx: tx}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return interfaceCounters{}, err
+	}
+	return interfaceCounters{}, fmt.Errorf("interface %s not found in /proc/net/dev", iface)
+}
@@ -0,0 +1,46 @@
+package speedtest
+
+import (
+	"strings"
+	"testing"
+)
+
+const procNetDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:   12345      67    0    0    0     0          0         0    12345      67    0    0    0     0       0          0
+  eth0:9876543210 1234567    0    0    0     0          0       100 123456789  654321    0    0    0     0       0          0
+wlan0: 100 1 0 0 0 0 0 0 200 2 0 0 0 0 0 0
+  bad0: 1 2 3
+`
+
+func TestParseInterfaceCounters(t *testing.T) {
+	tests := []struct {
+		iface string
+		want  interfaceCounters
+		err   bool
+	}{
+		{iface: "lo", want: interfaceCounters{rx: 12345, tx: 12345}},
+		{iface: "eth0", want: interfaceCounters{rx: 9876543210, tx: 123456789}},
+		{iface: "wlan0", want: interfaceCounters{rx: 100, tx: 200}},
+		{iface: "eth", err: true},
+		{iface: "bad0", err: true},
+		{iface: "face", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseInterfaceCounters(strings.NewReader(procNetDev), test.iface)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseInterfaceCounters(%q) = %+v, want an error", test.iface, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseInterfaceCounters(%q) failed: %s", test.iface, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseInterfaceCounters(%q) = %+v, want %+v", test.iface, got, test.want)
+		}
+	}
+}
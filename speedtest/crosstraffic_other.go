@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package speedtest
+
+import "fmt"
+
+func readInterfaceCounters(iface string) (interfaceCounters, error) {
+	return interfaceCounters{}, fmt.Errorf("interface counters are only supported on Linux")
+}
@@ -0,0 +1,292 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// dialer opens every connection a Client makes, so that its network settings
+// apply to all of them.
+type dialer struct {
+	// family is "4" or "6" to force IPv4 or IPv6, or empty to let the system
+	// choose.
+	family string
+
+	// source, if set, is the local address connections are made from.
+	source net.IP
+
+	// iface, if set, is the network interface connections are bound to.
+	iface string
+
+	// proxy, if set, is the SOCKS5 or HTTP proxy TCP connections are
+	// tunnelled through.
+	proxy *url.URL
+
+	// mu guards tunnels, the time the proxy took to open each tunnel since
+	// they were last taken.
+	mu      sync.Mutex
+	tunnels []time.Duration
+
+	// version is the IP version of the last connection made since it was
+	// last taken, accessed atomically.
+	version int32
+
+	// bytes is the number of bytes sent and received over the dialer's
+	// connections since it was last taken, accessed atomically.
+	bytes uint64
+}
+
+// newDialer creates a dialer for the network settings in config.
+func newDialer(config *Config) (*dialer, error) {
+	d := &dialer{iface: config.Interface}
+	switch config.AddressFamily {
+	case "":
+	case "v4":
+		d.family = "4"
+	case "v6":
+		d.family = "6"
+	default:
+		return nil, fmt.Errorf("unknown address family %q", config.AddressFamily)
+	}
+
+	if config.SourceAddress != "" {
+		d.source = net.ParseIP(config.SourceAddress)
+		if d.source == nil {
+			return nil, fmt.Errorf("invalid source address %q", config.SourceAddress)
+		}
+	}
+	if config.Proxy != "" {
+		if d.family != "" {
+			// the proxy resolves the server's name and picks the family
+			// it connects over, so the results couldn't be told apart.
+			return nil, fmt.Errorf("an address family can't be selected when testing through a proxy")
+		}
+		proxy, err := parseProxy(config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		d.proxy = proxy
+	}
+	return d, nil
+}
+
+// DialContext connects to addr over network, which is "tcp" or "udp". TCP
+// connections go through the proxy if there is one; proxies can't carry UDP,
+// so it is always sent directly.
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.dial(ctx, network, addr, dialTimeout)
+}
+
+func (d *dialer) dial(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	if d.proxy == nil || network != "tcp" {
+		conn, err := d.dialDirect(ctx, network, addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		d.record(conn.RemoteAddr().String())
+		return conn, nil
+	}
+	if addr == d.proxy.Host {
+		// an http.Transport forwarding a request through an HTTP proxy
+		// connects to the proxy itself.
+		return d.dialDirect(ctx, network, addr, timeout)
+	}
+
+	conn, err := d.dialDirect(ctx, network, d.proxy.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if err := d.tunnel(ctx, conn, addr, timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.mu.Lock()
+	d.tunnels = append(d.tunnels, time.Since(start))
+	d.mu.Unlock()
+	return conn, nil
+}
+
+// dialDirect connects to addr without going through the proxy. Only dial
+// records the IP version, since that of a connection to the proxy says nothing
+// about the path to the server.
+func (d *dialer) dialDirect(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	nd := net.Dialer{Timeout: timeout, Control: d.control}
+	if d.source != nil {
+		if network == "udp" {
+			nd.LocalAddr = &net.UDPAddr{IP: d.source}
+		} else {
+			nd.LocalAddr = &net.TCPAddr{IP: d.source}
+		}
+	}
+	conn, err := nd.DialContext(ctx, network+d.family, addr)
+	if err != nil {
+		return nil, err
+	}
+	if udp, ok := conn.(*net.UDPConn); ok {
+		// resolvers only frame DNS messages for UDP if the connection is
+		// still a net.PacketConn.
+		return &countingUDPConn{UDPConn: udp, n: &d.bytes}, nil
+	}
+	counted := &countingConn{Conn: conn, n: &d.bytes}
+	if col := tcpInfoFrom(ctx); col != nil && network == "tcp" {
+		counted.tcpInfo = col
+		col.add(counted)
+	}
+	return counted, nil
+}
+
+// bytesSoFar returns the number of bytes sent and received over the dialer's
+// connections since takeBytes was last called.
+func (d *dialer) bytesSoFar() uint64 {
+	return atomic.LoadUint64(&d.bytes)
+}
+
+// takeBytes returns the number of bytes sent and received over the dialer's
+// connections since the last call.
+func (d *dialer) takeBytes() uint64 {
+	return atomic.SwapUint64(&d.bytes, 0)
+}
+
+// countingConn atomically adds the bytes read and written over a connection
+// to *n, and hands the connection to tcpInfo, if set, as it is closed.
+type countingConn struct {
+	net.Conn
+	n       *uint64
+	tcpInfo *tcpInfoCollector
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	if c.tcpInfo != nil {
+		c.tcpInfo.closing(c)
+	}
+	return c.Conn.Close()
+}
+
+// countingUDPConn is a countingConn for UDP.
+type countingUDPConn struct {
+	*net.UDPConn
+	n *uint64
+}
+
+func (c *countingUDPConn) Read(p []byte) (int, error) {
+	n, err := c.UDPConn.Read(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
+
+func (c *countingUDPConn) Write(p []byte) (int, error) {
+	n, err := c.UDPConn.Write(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
+
+// control binds sockets the net package creates to the dialer's interface.
+func (d *dialer) control(network, address string, c syscall.RawConn) error {
+	if d.iface == "" {
+		return nil
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) { err = bindToDevice(int(fd), d.iface) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// listenPacket opens a packet socket on network with the dialer's source
+// address and interface.
+func (d *dialer) listenPacket(ctx context.Context, network string) (net.PacketConn, error) {
+	var source string
+	if d.source != nil {
+		source = d.source.String()
+	}
+	lc := net.ListenConfig{Control: d.control}
+	return lc.ListenPacket(ctx, network, source)
+}
+
+// httpProxy is the Proxy for an http.Transport that dials with d. Plain HTTP
+// requests are forwarded through a configured HTTP proxy, since proxies
+// commonly refuse CONNECT to ports other than 443; everything else is
+// tunnelled by the dialer. The environment's proxy is only used without a
+// configured one, since connections to it would be tunnelled through the
+// configured proxy anyway.
+func (d *dialer) httpProxy(req *http.Request) (*url.URL, error) {
+	if d.proxy == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+	if d.proxy.Scheme == "http" && req.URL.Scheme == "http" {
+		return d.proxy, nil
+	}
+	return nil, nil
+}
+
+// takeTunnels returns the time the proxy took to open each tunnel since the
+// last call.
+func (d *dialer) takeTunnels() []time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tunnels := d.tunnels
+	d.tunnels = nil
+	return tunnels
+}
+
+// record notes the IP version of a connection to addr.
+func (d *dialer) record(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return
+	}
+	version := int32(6)
+	if ip.To4() != nil {
+		version = 4
+	}
+	atomic.StoreInt32(&d.version, version)
+}
+
+// takeIPVersion returns the IP version of the last connection made since the
+// last call, or zero if none has been.
+func (d *dialer) takeIPVersion() int {
+	return int(atomic.SwapInt32(&d.version, 0))
+}
+
+// lookupIP looks up the first address of host, which may include a port, in
+// the dialer's address family.
+func (d *dialer) lookupIP(ctx context.Context, host string) (net.IP, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		v4 := addr.IP.To4() != nil
+		if d.family == "" || (d.family == "4") == v4 {
+			return addr.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no IPv%s address", host, d.family)
+}
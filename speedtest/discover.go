@@ -0,0 +1,153 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	geo "github.com/kellydunn/golang-geo"
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+const (
+	clientConfigURL  = "http://www.speedtest.net/speedtest-config.php"
+	serverListURL    = "http://www.speedtest.net/speedtest-servers-static.php"
+	discoveryTimeout = 10 * time.Second
+	userAgent        = "Mozilla/5.0 (Windows NT 6.1; WOW64; rv:40.0) Gecko/20100101 Firefox/40.1"
+)
+
+type clientConfig struct {
+	Client struct {
+		Lat  float64 `xml:"lat,attr"`
+		Long float64 `xml:"lon,attr"`
+	} `xml:"client"`
+	ServerConfig struct {
+		IgnoreIDs string `xml:"ignoreids,attr"`
+	} `xml:"server-config"`
+}
+
+type serverList struct {
+	Servers []struct {
+		URL     string  `xml:"url,attr"`
+		URL2    string  `xml:"url2,attr"`
+		Lat     float64 `xml:"lat,attr"`
+		Long    float64 `xml:"lon,attr"`
+		Name    string  `xml:"name,attr"`
+		Country string  `xml:"country,attr"`
+		Sponsor string  `xml:"sponsor,attr"`
+		ID      string  `xml:"id,attr"`
+		Host    string  `xml:"host,attr"`
+	} `xml:"servers>server"`
+}
+
+type byDistance []stdn.Testserver
+
+func (s byDistance) Len() int           { return len(s) }
+func (s byDistance) Less(i, j int) bool { return s[i].Distance < s[j].Distance }
+func (s byDistance) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// closestAvailableServer returns a Backend for the first server in servers that
+// isn't blacklisted and answers a latency probe.
+func closestAvailableServer(ctx context.Context, servers []stdn.Testserver, serverBlacklist []string, newBackend backendFactory) (Backend, error) {
+	blacklist := make(map[string]struct{})
+
+	for _, s := range serverBlacklist {
+		blacklist[s] = struct{}{}
+	}
+
+	for i := range servers {
+		s := &servers[i]
+		if _, ok := blacklist[s.Host]; ok {
+			// server is blacklisted, skip.
+			continue
+		}
+
+		backend, err := newBackend(s)
+		if err == nil {
+			var samples []time.Duration
+			samples, _, err = backend.Latency(ctx, 1, 0)
+			if err == nil && len(samples) == 0 {
+				err = fmt.Errorf("ping timed out")
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("failed to connect to %s, trying another. Error: %s", s.Host, err)
+			continue
+		}
+		return backend, nil
+	}
+
+	return nil, fmt.Errorf("no available servers")
+}
+
+// fetchServers fetches the list of speedtest.net servers, sorted by distance
+// from the client.
+func fetchServers(ctx context.Context, client *http.Client) ([]stdn.Testserver, error) {
+	var cc clientConfig
+	if err := fetchXML(ctx, client, clientConfigURL, &cc); err != nil {
+		return nil, err
+	}
+	var sl serverList
+	if err := fetchXML(ctx, client, serverListURL, &sl); err != nil {
+		return nil, err
+	}
+
+	ignored := make(map[string]struct{})
+	for _, id := range strings.Split(cc.ServerConfig.IgnoreIDs, ",") {
+		ignored[strings.TrimSpace(id)] = struct{}{}
+	}
+
+	here := geo.NewPoint(cc.Client.Lat, cc.Client.Long)
+	var servers []stdn.Testserver
+	for _, s := range sl.Servers {
+		if _, ok := ignored[s.ID]; ok {
+			continue
+		}
+		server := stdn.Testserver{
+			Name:     s.Name,
+			Sponsor:  s.Sponsor,
+			Country:  s.Country,
+			Lat:      s.Lat,
+			Long:     s.Long,
+			Distance: here.GreatCircleDistance(geo.NewPoint(s.Lat, s.Long)),
+			Host:     s.Host,
+		}
+		for _, u := range []string{s.URL, s.URL2} {
+			if u != "" {
+				server.URLs = append(server.URLs, u)
+			}
+		}
+		servers = append(servers, server)
+	}
+	sort.Sort(byDistance(servers))
+
+	return servers, nil
+}
+
+// fetchXML decodes the XML document at url into v.
+func fetchXML(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,123 @@
+package speedtest
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	dnsTimeout         = 5 * time.Second
+	dnsDefaultPort     = "53"
+	systemResolverName = "system"
+)
+
+// defaultDNSNames are looked up when DNSConfig.Names is empty.
+var defaultDNSNames = []string{"www.google.com", "www.datadoghq.com"}
+
+// DNSConfig configures the DNS probe, which times lookups through the system
+// resolver and any others listed.
+type DNSConfig struct {
+	// Names are the host names looked up through each resolver. Empty means
+	// defaultDNSNames. Names in the hosts file are answered from it without
+	// querying any resolver.
+	Names []string `json:"names,omitempty"`
+
+	// Resolvers are the host[:port] addresses of DNS servers to query
+	// directly, as well as the system resolver.
+	Resolvers []string `json:"resolvers,omitempty"`
+}
+
+// DNSResult is the outcome of looking up every name through one resolver.
+type DNSResult struct {
+	// Resolver is the address of the DNS server, or "system" for the system
+	// resolver.
+	Resolver string
+
+	// Latency holds the time taken by each successful lookup. Its Lost is the
+	// number of lookups that timed out.
+	Latency LatencyStats
+
+	Queries int
+
+	// Failures is the number of lookups that failed for any reason,
+	// including the NXDOMAIN and SERVFAIL responses counted in NXDomain and
+	// ServFail.
+	Failures int
+	NXDomain int
+
+	// ServFail is the number of lookups that failed temporarily without
+	// timing out, which is how a SERVFAIL response is reported. A resolver
+	// that refuses queries outright is counted the same.
+	ServFail int
+}
+
+// probeDNS looks up the configured names through each resolver in turn. The
+// listed resolvers are queried over connections made with d.
+func probeDNS(ctx context.Context, config *DNSConfig, d *dialer) []DNSResult {
+	names := config.Names
+	if len(names) == 0 {
+		names = defaultDNSNames
+	}
+
+	results := []DNSResult{probeResolver(ctx, systemResolverName, net.DefaultResolver, names)}
+	for _, addr := range config.Resolvers {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, dnsDefaultPort)
+		}
+		results = append(results, probeResolver(ctx, addr, newResolver(addr, d), names))
+	}
+	return results
+}
+
+// newResolver returns a resolver that sends every query to the DNS server at
+// addr over connections made with d.
+func newResolver(addr string, d *dialer) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.dial(ctx, network, addr, dnsTimeout)
+		},
+	}
+}
+
+func probeResolver(ctx context.Context, name string, resolver *net.Resolver, names []string) DNSResult {
+	result := DNSResult{Resolver: name}
+	var samples []time.Duration
+	var lost int
+	for _, host := range names {
+		if ctx.Err() != nil {
+			break
+		}
+
+		lookupCtx, cancel := context.WithTimeout(ctx, dnsTimeout)
+		start := time.Now()
+		_, err := resolver.LookupIPAddr(lookupCtx, host)
+		elapsed := time.Since(start)
+		cancel()
+		if ctx.Err() != nil {
+			break
+		}
+
+		result.Queries++
+		if err == nil {
+			samples = append(samples, elapsed)
+			continue
+		}
+
+		result.Failures++
+		if dnsErr, ok := err.(*net.DNSError); ok {
+			switch {
+			case dnsErr.IsTimeout:
+				lost++
+			case dnsErr.IsNotFound:
+				result.NXDomain++
+			case dnsErr.IsTemporary:
+				result.ServFail++
+			}
+		}
+	}
+
+	result.Latency = newLatencyStats(samples, lost)
+	return result
+}
@@ -0,0 +1,269 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+// randomImageSizes are the sides of the square random images a speedtest.net
+// server offers for download, smallest first.
+var randomImageSizes = []int{350, 500, 750, 1000, 1500, 2000, 2500, 3000, 3500, 4000}
+
+// httpBackend runs tests over HTTP(S), downloading from and uploading to a
+// server's URLs.
+type httpBackend struct {
+	client *http.Client
+	server ServerInfo
+
+	// downloadURL is the URL of the step'th download size, for steps up to
+	// maxDownloadStep.
+	downloadURL     func(step int) string
+	maxDownloadStep int
+
+	uploadURL  string
+	latencyURL func() string
+}
+
+// NewHTTPBackend creates a Backend that tests against a speedtest.net server
+// over HTTP(S) using its upload URLs, for networks that block its TCP
+// protocol.
+func NewHTTPBackend(server *stdn.Testserver) (Backend, error) {
+	return newHTTPBackend(server, &dialer{})
+}
+
+func newHTTPBackend(server *stdn.Testserver, d *dialer) (Backend, error) {
+	if len(server.URLs) == 0 {
+		return nil, fmt.Errorf("server %s has no HTTP URLs", server.Host)
+	}
+	base, err := url.Parse(server.URLs[0])
+	if err != nil {
+		return nil, err
+	}
+	base, err = base.Parse(".")
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpBackend{
+		client: newHTTPClient(d),
+		server: ServerInfo{Host: base.Host, Location: server.Name},
+		downloadURL: func(step int) string {
+			side := randomImageSizes[step]
+			return resolve(base, fmt.Sprintf("random%dx%d.jpg", side, side))
+		},
+		maxDownloadStep: len(randomImageSizes) - 1,
+		uploadURL:       resolve(base, "upload.php"),
+		latencyURL: func() string {
+			return resolve(base, fmt.Sprintf("latency.txt?x=%d", time.Now().UnixNano()))
+		},
+	}, nil
+}
+
+func newHTTPClient(d *dialer) *http.Client {
+	transport := &http.Transport{
+		DialContext:         d.DialContext,
+		TLSHandshakeTimeout: dialTimeout,
+		MaxIdleConnsPerHost: 64,
+		DisableCompression:  true,
+	}
+	return &http.Client{Transport: transport}
+}
+
+// resolve resolves the relative URL ref against base.
+func resolve(base *url.URL, ref string) string {
+	u, err := base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return u.String()
+}
+
+func (b *httpBackend) Download(ctx context.Context, opts TransferOptions) (*Transfer, error) {
+	b.fresh()
+	return runStreams(ctx, opts, func(ctx context.Context, deadline time.Time, n *uint64) error {
+		return b.stream(ctx, deadline, func(ctx context.Context, step int) error {
+			req, err := http.NewRequest("GET", b.downloadURL(step), nil)
+			if err != nil {
+				return err
+			}
+			return b.do(ctx, req, n)
+		}, b.maxDownloadStep)
+	})
+}
+
+func (b *httpBackend) Upload(ctx context.Context, opts TransferOptions) (*Transfer, error) {
+	b.fresh()
+	return runStreams(ctx, opts, func(ctx context.Context, deadline time.Time, n *uint64) error {
+		return b.stream(ctx, deadline, func(ctx context.Context, step int) error {
+			size := startChunkSize << uint(step)
+			body := &countingReader{r: newUploadBody(size), n: n}
+			req, err := http.NewRequest("POST", b.uploadURL, body)
+			if err != nil {
+				return err
+			}
+			req.ContentLength = int64(size)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return b.do(ctx, req, nil)
+		}, chunkSteps())
+	})
+}
+
+func (b *httpBackend) Latency(ctx context.Context, count int, interval time.Duration) ([]time.Duration, int, error) {
+	probe := func() (time.Duration, error) {
+		ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+		defer cancel()
+		req, err := http.NewRequest("GET", b.latencyURL(), nil)
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		err = b.do(ctx, req, nil)
+		return time.Since(start), err
+	}
+
+	// warm up the connection so that the first sample doesn't include the
+	// handshakes.
+	if _, err := probe(); err != nil && ctx.Err() == nil {
+		return nil, 0, err
+	}
+
+	var samples []time.Duration
+	var lost int
+	for i := 0; count == 0 || i < count; i++ {
+		if !wait(interval, ctx.Done()) {
+			break
+		}
+		rtt, err := probe()
+		if ctx.Err() != nil {
+			break
+		}
+		if isTimeout(err) {
+			lost++
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		samples = append(samples, rtt)
+	}
+
+	return samples, lost, nil
+}
+
+// fresh closes the idle connections left by earlier requests, so that a
+// transfer's connections are all dialed for it, and their TCPInfo collected.
+func (b *httpBackend) fresh() {
+	b.client.CloseIdleConnections()
+}
+
+func (b *httpBackend) Server() ServerInfo {
+	return b.server
+}
+
+// stream repeatedly runs request until deadline passes, stepping up the size
+// of each request, up to maxStep, while requests complete faster than
+// chunkTarget. A request still in flight at the deadline is cut short.
+func (b *httpBackend) stream(ctx context.Context, deadline time.Time, request func(context.Context, int) error, maxStep int) error {
+	streamCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	step := 0
+	for {
+		start := time.Now()
+		err := request(streamCtx, step)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if streamCtx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if time.Since(start) < chunkTarget && step < maxStep {
+			step++
+		}
+	}
+}
+
+// do sends req and reads the whole response, atomically adding the size of the
+// body to *n if n is not nil.
+func (b *httpBackend) do(ctx context.Context, req *http.Request, n *uint64) error {
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if n != nil {
+		body = &countingReader{r: resp.Body, n: n}
+	}
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	return nil
+}
+
+// countingReader atomically adds the number of bytes read through it to *n.
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
+
+// newUploadBody returns a form body of exactly size bytes.
+func newUploadBody(size int) io.Reader {
+	const field = "content1="
+	if size < len(field) {
+		return strings.NewReader(field[:size])
+	}
+	return io.MultiReader(strings.NewReader(field), &filler{remaining: size - len(field)})
+}
+
+// filler reads as the given number of bytes of payload.
+type filler struct {
+	remaining int
+}
+
+func (f *filler) Read(p []byte) (int, error) {
+	if f.remaining == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n := 0
+	for n < len(p) {
+		n += copy(p[n:], payload)
+	}
+	f.remaining -= n
+	return n, nil
+}
+
+// chunkSteps is the number of times the chunk size can double from
+// startChunkSize before reaching maxChunkSize.
+func chunkSteps() int {
+	steps := 0
+	for size := startChunkSize; size < maxChunkSize; size *= 2 {
+		steps++
+	}
+	return steps
+}
@@ -0,0 +1,119 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+// fakeSpeedtestNet serves the HTTP endpoints of a speedtest.net server under
+// /speedtest/, noting the path of each request.
+type fakeSpeedtestNet struct {
+	mu    sync.Mutex
+	paths []string
+
+	// uploadStatus, if set, is the status of every upload.
+	uploadStatus int
+}
+
+func (f *fakeSpeedtestNet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.paths = append(f.paths, r.URL.Path)
+	f.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/speedtest/latency.txt":
+		io.WriteString(w, "test=test\n")
+	case r.URL.Path == "/speedtest/upload.php" && r.Method == "POST":
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		if f.uploadStatus != 0 {
+			w.WriteHeader(f.uploadStatus)
+		}
+		fmt.Fprintf(w, "size=%d", n)
+	case strings.HasPrefix(r.URL.Path, "/speedtest/random"):
+		// roughly the size of the real JPEGs.
+		var side int
+		fmt.Sscanf(r.URL.Path, "/speedtest/random%dx", &side)
+		io.Copy(w, &filler{remaining: side * side / 4})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeSpeedtestNet) requested(prefix string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.paths {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func newFakeSpeedtestNetBackend(t *testing.T, fake *fakeSpeedtestNet) Backend {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	backend, err := NewHTTPBackend(&stdn.Testserver{
+		Name: "Fake",
+		Host: strings.TrimPrefix(server.URL, "http://"),
+		URLs: []string{server.URL + "/speedtest/upload.php"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestHTTPBackendRoundTrip(t *testing.T) {
+	fake := &fakeSpeedtestNet{}
+	backend := newFakeSpeedtestNetBackend(t, fake)
+	ctx := context.Background()
+
+	for name, transfer := range map[string]func(context.Context, TransferOptions) (*Transfer, error){
+		"download": backend.Download,
+		"upload":   backend.Upload,
+	} {
+		got, err := transfer(ctx, testOptions(2))
+		if err != nil {
+			t.Errorf("%s failed: %s", name, err)
+			continue
+		}
+		if len(got.Streams) != 2 || got.Bytes == 0 || got.Speed <= 0 {
+			t.Errorf("%s = %+v, want two streams that moved data", name, got)
+		}
+	}
+	if !fake.requested("/speedtest/random350x350.jpg") {
+		t.Errorf("downloads didn't start from the smallest image: %v", fake.paths)
+	}
+
+	samples, lost, err := backend.Latency(ctx, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 3 || lost != 0 {
+		t.Errorf("Latency = %v with %d lost, want 3 samples", samples, lost)
+	}
+}
+
+func TestHTTPBackendUploadError(t *testing.T) {
+	backend := newFakeSpeedtestNetBackend(t, &fakeSpeedtestNet{uploadStatus: http.StatusForbidden})
+	_, err := backend.Upload(context.Background(), testOptions(1))
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden") {
+		t.Errorf("Upload = %v, want a 403 error", err)
+	}
+}
+
+func TestNewHTTPBackendWithoutURLs(t *testing.T) {
+	if _, err := NewHTTPBackend(&stdn.Testserver{Host: "example.com:8080"}); err == nil {
+		t.Error("NewHTTPBackend of a server without URLs succeeded")
+	}
+}
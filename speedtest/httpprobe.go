@@ -0,0 +1,131 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const httpProbeTimeout = 10 * time.Second
+
+// HTTPTarget is a URL timed by the HTTP probe.
+type HTTPTarget struct {
+	// Name identifies the target in results and metrics. Empty means the
+	// URL's host.
+	Name string `json:"name,omitempty"`
+
+	URL string `json:"url"`
+}
+
+// HTTPResult is the outcome of fetching one HTTPTarget over a fresh
+// connection.
+type HTTPResult struct {
+	Target string
+	Status int
+	Err    error
+
+	// DNS, Connect and TLS are how long each phase of setting up the
+	// connection took. TLS is zero for plain HTTP.
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+
+	// TTFB is the time from starting the request to receiving the first byte
+	// of the response, and Total the time to receiving all of it.
+	TTFB  time.Duration
+	Total time.Duration
+}
+
+// probeHTTP fetches each target in turn.
+func probeHTTP(ctx context.Context, targets []HTTPTarget, d *dialer) []HTTPResult {
+	var results []HTTPResult
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		results = append(results, probeHTTPTarget(ctx, target, d))
+	}
+	return results
+}
+
+func probeHTTPTarget(ctx context.Context, target HTTPTarget, d *dialer) HTTPResult {
+	result := HTTPResult{Target: target.Name}
+	u, err := url.Parse(target.URL)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if result.Target == "" {
+		result.Target = u.Host
+	}
+
+	// dialing may race IPv4 and IPv6 connections, so the connect hooks can
+	// run concurrently.
+	var mu sync.Mutex
+	var start, dnsStart, connectStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { result.DNS = time.Since(dnsStart) },
+		ConnectStart: func(string, string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if connectStart.IsZero() {
+				connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(_, _ string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				result.Connect = time.Since(connectStart)
+			}
+		},
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { result.TLS = time.Since(tlsStart) },
+		GotFirstResponseByte: func() { result.TTFB = time.Since(start) },
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, httpProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	// a new transport for every request, so that every phase is measured
+	// rather than reusing an earlier connection.
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             d.httpProxy,
+		DialContext:       d.DialContext,
+		DisableKeepAlives: true,
+	}}
+
+	start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		result.Err = err
+		return result
+	}
+	result.Total = time.Since(start)
+	result.Status = resp.StatusCode
+	if resp.StatusCode >= 400 {
+		result.Err = fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return result
+}
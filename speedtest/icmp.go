@@ -0,0 +1,202 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	defaultICMPInterval = 200 * time.Millisecond
+
+	icmpEchoRequest   = 8
+	icmpEchoReply     = 0
+	icmp6EchoRequest  = 128
+	icmp6EchoReply    = 129
+	icmpEchoHeaderLen = 8
+	icmpTokenLen      = 8
+)
+
+// ICMPConfig configures the ICMP probe, which pings hosts that don't run a
+// speedtest server, such as the gateway or upstream routers.
+type ICMPConfig struct {
+	// Hosts are the names or addresses of the hosts to ping.
+	Hosts []string `json:"hosts"`
+
+	// Count is the number of pings sent to each host. Zero means
+	// defaultPingCount.
+	Count int `json:"count,omitempty"`
+
+	// Interval is the time between pings. Zero means defaultICMPInterval.
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// ICMPResult is the outcome of pinging one host.
+type ICMPResult struct {
+	Host string
+
+	// Addr is the address that was pinged.
+	Addr string
+
+	// Err is set if the host couldn't be pinged at all, such as when its
+	// name doesn't resolve or ICMP sockets aren't permitted.
+	Err error
+
+	// Latency holds the round trip time of each answered ping. Its Lost is
+	// the number that went unanswered.
+	Latency LatencyStats
+}
+
+// probeICMP pings each host in turn.
+func probeICMP(ctx context.Context, config *ICMPConfig, d *dialer) []ICMPResult {
+	count := config.Count
+	if count <= 0 {
+		count = defaultPingCount
+	}
+	interval := time.Duration(config.Interval)
+	if interval <= 0 {
+		interval = defaultICMPInterval
+	}
+
+	var results []ICMPResult
+	for _, host := range config.Hosts {
+		if ctx.Err() != nil {
+			break
+		}
+		result := ICMPResult{Host: host}
+		ip, err := d.lookupIP(ctx, host)
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		result.Addr = ip.String()
+
+		samples, lost, err := pingICMP(ctx, d, ip, count, interval)
+		result.Err = err
+		result.Latency = newLatencyStats(samples, lost)
+		results = append(results, result)
+	}
+	return results
+}
+
+// pingICMP sends count echo requests to ip, interval apart, waiting up to
+// pingTimeout for each reply.
+func pingICMP(ctx context.Context, d *dialer, ip net.IP, count int, interval time.Duration) ([]time.Duration, int, error) {
+	v6 := ip.To4() == nil
+	conn, addr, err := listenICMP(ctx, d, ip, v6)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	// the kernel picks the identifier of datagram sockets, and raw sockets
+	// see every echo reply on the host, so replies are matched by a token
+	// in their payload.
+	token := make([]byte, icmpTokenLen)
+	if _, err := rand.Read(token); err != nil {
+		return nil, 0, err
+	}
+	request := make([]byte, icmpEchoHeaderLen+icmpTokenLen)
+	request[0] = icmpEchoRequest
+	replyType := byte(icmpEchoReply)
+	if v6 {
+		request[0] = icmp6EchoRequest
+		replyType = icmp6EchoReply
+	}
+	copy(request[4:6], token)
+	copy(request[icmpEchoHeaderLen:], token)
+
+	var samples []time.Duration
+	var lost int
+	buf := make([]byte, 1500)
+	for seq := 0; seq < count; seq++ {
+		delay := interval
+		if seq == 0 {
+			delay = 0
+		}
+		if !wait(delay, ctx.Done()) {
+			break
+		}
+
+		binary.BigEndian.PutUint16(request[6:8], uint16(seq))
+		request[2], request[3] = 0, 0
+		if !v6 {
+			// the kernel fills in ICMPv6 checksums itself.
+			binary.BigEndian.PutUint16(request[2:4], icmpChecksum(request))
+		}
+
+		start := time.Now()
+		if _, err := conn.WriteTo(request, addr); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return nil, 0, err
+		}
+		if err := conn.SetReadDeadline(start.Add(pingTimeout)); err != nil {
+			return nil, 0, err
+		}
+
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if ctx.Err() != nil {
+				return samples, lost, nil
+			}
+			if isTimeout(err) {
+				lost++
+				break
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			reply := buf[:n]
+			if len(reply) < icmpEchoHeaderLen+icmpTokenLen || reply[0] != replyType ||
+				int(binary.BigEndian.Uint16(reply[6:8])) != seq ||
+				!bytes.Equal(reply[icmpEchoHeaderLen:icmpEchoHeaderLen+icmpTokenLen], token) {
+				continue
+			}
+			samples = append(samples, time.Since(start))
+			break
+		}
+	}
+	return samples, lost, nil
+}
+
+// listenICMP opens a socket to ping ip with, and returns the address to send
+// the pings to. Unprivileged datagram sockets are preferred, falling back to
+// raw sockets, which need privileges.
+func listenICMP(ctx context.Context, d *dialer, ip net.IP, v6 bool) (net.PacketConn, net.Addr, error) {
+	if conn, err := listenDatagramICMP(d, v6); err == nil {
+		return conn, &net.UDPAddr{IP: ip}, nil
+	}
+
+	network := "ip4:icmp"
+	if v6 {
+		network = "ip6:ipv6-icmp"
+	}
+	conn, err := d.listenPacket(ctx, network)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, &net.IPAddr{IP: ip}, nil
+}
+
+// icmpChecksum is the Internet checksum of b.
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
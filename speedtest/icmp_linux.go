@@ -0,0 +1,28 @@
+package speedtest
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenDatagramICMP opens a datagram ICMP socket, which Linux lets members
+// of the groups in net.ipv4.ping_group_range open without privileges.
+func listenDatagramICMP(d *dialer, v6 bool) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if v6 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := d.bindFD(fd, v6); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
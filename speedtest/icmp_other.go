@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package speedtest
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenDatagramICMP(d *dialer, v6 bool) (net.PacketConn, error) {
+	return nil, fmt.Errorf("datagram ICMP sockets are only supported on Linux")
+}
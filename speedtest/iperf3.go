@@ -0,0 +1,493 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	iperf3DefaultPort = "5201"
+	iperf3BlockSize   = 128 * 1024
+	iperf3Version     = "3.1.3"
+
+	// iperf3CookieChars is the alphabet iperf3 draws session cookies from.
+	iperf3CookieChars = "abcdefghijklmnopqrstuvwxyz234567"
+	iperf3CookieSize  = 37
+
+	// maxIperf3JSON caps the size of the JSON messages a server may send.
+	maxIperf3JSON = 1024 * 1024
+)
+
+// iperf3 control connection states.
+const (
+	iperf3TestStart       = 1
+	iperf3TestRunning     = 2
+	iperf3TestEnd         = 4
+	iperf3ParamExchange   = 9
+	iperf3CreateStreams   = 10
+	iperf3ServerTerminate = 11
+	iperf3ClientTerminate = 12
+	iperf3ExchangeResults = 13
+	iperf3DisplayResults  = 14
+	iperf3Done            = 16
+	iperf3AccessDenied    = -1
+	iperf3ServerError     = -2
+)
+
+// iperf3Backend runs tests against an iperf3 server using its TCP control and
+// data protocol.
+type iperf3Backend struct {
+	host string
+	dial *dialer
+
+	// setup is held while a test's connections are being established, so
+	// that latency probes can't be mistaken for its data streams.
+	setup sync.Mutex
+}
+
+// NewIperf3Backend creates a Backend that tests against the iperf3 server at
+// host, which defaults to port 5201.
+func NewIperf3Backend(host string) Backend {
+	return newIperf3Backend(host, &dialer{})
+}
+
+func newIperf3Backend(host string, d *dialer) Backend {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, iperf3DefaultPort)
+	}
+	return &iperf3Backend{host: host, dial: d}
+}
+
+type iperf3Params struct {
+	TCP           bool   `json:"tcp,omitempty"`
+	Reverse       bool   `json:"reverse,omitempty"`
+	Omit          int    `json:"omit"`
+	Time          int    `json:"time"`
+	Parallel      int    `json:"parallel"`
+	Len           int    `json:"len"`
+	ClientVersion string `json:"client_version"`
+}
+
+type iperf3Results struct {
+	CPUUtilTotal         float64              `json:"cpu_util_total"`
+	CPUUtilUser          float64              `json:"cpu_util_user"`
+	CPUUtilSystem        float64              `json:"cpu_util_system"`
+	SenderHasRetransmits int                  `json:"sender_has_retransmits"`
+	Streams              []iperf3StreamResult `json:"streams"`
+}
+
+type iperf3StreamResult struct {
+	ID          int     `json:"id"`
+	Bytes       uint64  `json:"bytes"`
+	Retransmits int     `json:"retransmits"`
+	Jitter      float64 `json:"jitter"`
+	Errors      int     `json:"errors"`
+	Packets     int     `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"`
+}
+
+func (b *iperf3Backend) Download(ctx context.Context, opts TransferOptions) (*Transfer, error) {
+	return b.test(ctx, opts, true)
+}
+
+func (b *iperf3Backend) Upload(ctx context.Context, opts TransferOptions) (*Transfer, error) {
+	return b.test(ctx, opts, false)
+}
+
+// Latency times how long the server takes to answer a session cookie, since
+// iperf3 has no echo service. Each probe then ends its session the way an
+// interrupted iperf3 client would, so that the server doesn't see a malformed
+// control connection.
+func (b *iperf3Backend) Latency(ctx context.Context, count int, interval time.Duration) ([]time.Duration, int, error) {
+	var samples []time.Duration
+	var lost int
+	for i := 0; count == 0 || i < count; i++ {
+		delay := interval
+		if i == 0 {
+			delay = 0
+		}
+		if !wait(delay, ctx.Done()) {
+			break
+		}
+
+		b.setup.Lock()
+		rtt, err := b.probe(ctx)
+		b.setup.Unlock()
+		if ctx.Err() != nil {
+			break
+		}
+		if isTimeout(err) {
+			lost++
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		samples = append(samples, rtt)
+	}
+	return samples, lost, nil
+}
+
+// probe times a single cookie exchange with the server. A server busy with
+// another test denies the session, which answers just as well.
+func (b *iperf3Backend) probe(ctx context.Context) (time.Duration, error) {
+	conn, err := b.dial.dial(ctx, "tcp", b.host, pingTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	cookie, err := newIperf3Cookie()
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if err := conn.SetDeadline(start.Add(pingTimeout)); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(cookie); err != nil {
+		return 0, err
+	}
+	var state [1]byte
+	if _, err := io.ReadFull(conn, state[:]); err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+
+	switch int8(state[0]) {
+	case iperf3ParamExchange:
+		conn.Write([]byte{iperf3ClientTerminate})
+	case iperf3AccessDenied:
+	default:
+		return 0, fmt.Errorf("unexpected iperf3 state %d, expected %d", int8(state[0]), iperf3ParamExchange)
+	}
+	return rtt, nil
+}
+
+func (b *iperf3Backend) Server() ServerInfo {
+	return ServerInfo{Host: b.host, Location: b.host}
+}
+
+// test runs a single iperf3 test, with the server sending if reverse is set.
+func (b *iperf3Backend) test(ctx context.Context, opts TransferOptions, reverse bool) (*Transfer, error) {
+	streams := opts.Streams
+	if streams < 1 {
+		streams = 1
+	}
+
+	b.setup.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			b.setup.Unlock()
+		}
+	}()
+
+	control, err := b.dial.DialContext(withoutTCPInfo(ctx), "tcp", b.host)
+	if err != nil {
+		return nil, err
+	}
+	defer control.Close()
+	stop := closeOnDone(ctx, control)
+	defer stop()
+
+	cookie, err := newIperf3Cookie()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := control.Write(cookie); err != nil {
+		return nil, err
+	}
+
+	if err := expectIperf3State(control, iperf3ParamExchange); err != nil {
+		return nil, err
+	}
+	params := iperf3Params{
+		TCP:           true,
+		Reverse:       reverse,
+		Time:          int(math.Ceil(opts.Duration.Seconds())),
+		Parallel:      streams,
+		Len:           iperf3BlockSize,
+		ClientVersion: iperf3Version,
+	}
+	if err := writeIperf3JSON(control, params); err != nil {
+		return nil, err
+	}
+
+	if err := expectIperf3State(control, iperf3CreateStreams); err != nil {
+		return nil, err
+	}
+	conns := make(chan *iperf3Stream, streams)
+	var all []*iperf3Stream
+	defer func() {
+		for _, s := range all {
+			s.conn.Close()
+		}
+	}()
+	for i := 0; i < streams; i++ {
+		conn, err := b.dial.DialContext(ctx, "tcp", b.host)
+		if err != nil {
+			return nil, err
+		}
+		s := &iperf3Stream{conn: conn, id: iperf3StreamID(i)}
+		all = append(all, s)
+		defer closeOnDone(ctx, conn)()
+		if _, err := conn.Write(cookie); err != nil {
+			return nil, err
+		}
+		conns <- s
+	}
+
+	if err := expectIperf3State(control, iperf3TestStart); err != nil {
+		return nil, err
+	}
+	if err := expectIperf3State(control, iperf3TestRunning); err != nil {
+		return nil, err
+	}
+	b.setup.Unlock()
+	locked = false
+
+	t, err := runStreams(ctx, opts, func(ctx context.Context, deadline time.Time, n *uint64) error {
+		s := <-conns
+		defer closeOnDone(ctx, s.conn)()
+		err := s.run(deadline, n, reverse)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.bytes = atomic.LoadUint64(n)
+		return err
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if reverse {
+		// keep draining what the server sends until it sees the test
+		// is over, so that it can't block writing to us.
+		for _, s := range all {
+			s.conn.SetDeadline(time.Time{})
+			go io.Copy(ioutil.Discard, s.conn)
+		}
+	}
+	if _, err := control.Write([]byte{iperf3TestEnd}); err != nil {
+		return nil, err
+	}
+	if err := expectIperf3State(control, iperf3ExchangeResults); err != nil {
+		return nil, err
+	}
+	var results iperf3Results
+	for _, s := range all {
+		results.Streams = append(results.Streams, iperf3StreamResult{
+			ID:          s.id,
+			Bytes:       s.bytes,
+			Retransmits: -1,
+			EndTime:     t.Duration.Seconds(),
+		})
+	}
+	if err := writeIperf3JSON(control, results); err != nil {
+		return nil, err
+	}
+	var serverResults iperf3Results
+	if err := readIperf3JSON(control, &serverResults); err != nil {
+		return nil, err
+	}
+	if err := expectIperf3State(control, iperf3DisplayResults); err != nil {
+		return nil, err
+	}
+	if _, err := control.Write([]byte{iperf3Done}); err != nil {
+		return nil, err
+	}
+
+	if !reverse {
+		receivedByServer(t, all, &serverResults)
+	}
+	return t, nil
+}
+
+// receivedByServer replaces the totals of upload t, which count what was
+// written into the local socket buffers, with what the server says each of
+// streams received, as iperf3's own client reports. t is left alone if the
+// server's results don't cover every stream. t's Samples are still of what
+// was written, so its SteadySpeed is scaled down by the share that arrived.
+func receivedByServer(t *Transfer, streams []*iperf3Stream, server *iperf3Results) {
+	received := make(map[int]iperf3StreamResult)
+	for _, r := range server.Streams {
+		received[r.ID] = r
+	}
+	elapsed := time.Duration(0)
+	for _, s := range streams {
+		r, ok := received[s.id]
+		if !ok {
+			return
+		}
+		if d := time.Duration((r.EndTime - r.StartTime) * float64(time.Second)); d > elapsed {
+			elapsed = d
+		}
+	}
+	if elapsed <= 0 {
+		elapsed = t.Duration
+	}
+
+	sent := t.Bytes
+	t.Bytes = 0
+	t.Streams = make([]StreamTransfer, len(streams))
+	for i, s := range streams {
+		n := received[s.id].Bytes
+		t.Streams[i] = StreamTransfer{Speed: speed(n, elapsed), Bytes: n}
+		t.Bytes += n
+	}
+	t.Duration = elapsed
+	t.Speed = speed(t.Bytes, elapsed)
+	if sent > 0 && t.Bytes < sent {
+		t.SteadySpeed = Speed(float64(t.SteadySpeed) * float64(t.Bytes) / float64(sent))
+	}
+}
+
+// iperf3Stream is a single data connection of an iperf3 test.
+type iperf3Stream struct {
+	conn  net.Conn
+	id    int
+	bytes uint64
+}
+
+// run moves data over the stream until deadline, receiving if reverse is set
+// and sending otherwise.
+func (s *iperf3Stream) run(deadline time.Time, n *uint64, reverse bool) error {
+	if err := s.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	buf := make([]byte, iperf3BlockSize)
+	if !reverse {
+		for i := range buf {
+			buf[i] = payload[i%len(payload)]
+		}
+	}
+	for {
+		var moved int
+		var err error
+		if reverse {
+			moved, err = s.conn.Read(buf)
+		} else {
+			moved, err = s.conn.Write(buf)
+		}
+		atomic.AddUint64(n, uint64(moved))
+		if isTimeout(err) && !time.Now().Before(deadline) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// iperf3StreamID is the ID iperf3 gives the i'th stream of a test. ID 2 is
+// skipped for historical reasons.
+func iperf3StreamID(i int) int {
+	if i == 0 {
+		return 1
+	}
+	return i + 2
+}
+
+func newIperf3Cookie() ([]byte, error) {
+	cookie := make([]byte, iperf3CookieSize)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+	for i := range cookie {
+		cookie[i] = iperf3CookieChars[int(cookie[i])%len(iperf3CookieChars)]
+	}
+	cookie[len(cookie)-1] = 0
+	return cookie, nil
+}
+
+// expectIperf3State reads the next state from the control connection and
+// checks that it is want.
+func expectIperf3State(control net.Conn, want int8) error {
+	if err := control.SetReadDeadline(time.Now().Add(transferTimeout)); err != nil {
+		return err
+	}
+	var state int8
+	if err := binary.Read(control, binary.BigEndian, &state); err != nil {
+		return err
+	}
+
+	switch state {
+	case want:
+		return nil
+	case iperf3AccessDenied:
+		return fmt.Errorf("iperf3 server is busy")
+	case iperf3ServerError:
+		var codes [2]int32
+		binary.Read(control, binary.BigEndian, &codes)
+		return fmt.Errorf("iperf3 server error %d (errno %d)", codes[0], codes[1])
+	case iperf3ServerTerminate, iperf3ClientTerminate:
+		return fmt.Errorf("iperf3 test terminated")
+	default:
+		return fmt.Errorf("unexpected iperf3 state %d, expected %d", state, want)
+	}
+}
+
+// writeIperf3JSON sends v as a length-prefixed JSON message.
+func writeIperf3JSON(control net.Conn, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(control, binary.BigEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err = control.Write(b)
+	return err
+}
+
+// readIperf3JSON reads a length-prefixed JSON message into v.
+func readIperf3JSON(control net.Conn, v interface{}) error {
+	if err := control.SetReadDeadline(time.Now().Add(transferTimeout)); err != nil {
+		return err
+	}
+	var size uint32
+	if err := binary.Read(control, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size > maxIperf3JSON {
+		return fmt.Errorf("iperf3 message of %d bytes is too large", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(control, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// closeOnDone closes conn once ctx is done. The returned function stops
+// watching ctx, and may be called more than once.
+func closeOnDone(ctx context.Context, conn io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -0,0 +1,221 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeIperf3 is an iperf3 server that runs one test at a time.
+type fakeIperf3 struct {
+	l net.Listener
+
+	// deny, if set, denies every test as if the server were busy, and huge
+	// sends results too large to read.
+	deny, huge bool
+
+	mu sync.Mutex
+	// received is the bytes each stream of the last upload received.
+	received []uint64
+	// probes counts the sessions ended right after the cookie exchange,
+	// and malformed the control connections that sent nothing valid.
+	probes, malformed int
+}
+
+// startFakeIperf3 starts f on a loopback port until the test ends.
+func startFakeIperf3(t *testing.T, f *fakeIperf3) *fakeIperf3 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f.l = l
+	go f.serve()
+	return f
+}
+
+func (f *fakeIperf3) serve() {
+	for {
+		control, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		f.session(control)
+		control.Close()
+	}
+}
+
+func (f *fakeIperf3) count(n *int) {
+	f.mu.Lock()
+	*n++
+	f.mu.Unlock()
+}
+
+func (f *fakeIperf3) session(control net.Conn) {
+	cookie := make([]byte, iperf3CookieSize)
+	if _, err := io.ReadFull(control, cookie); err != nil {
+		f.count(&f.malformed)
+		return
+	}
+	if f.deny {
+		control.Write([]byte{0xff})
+		return
+	}
+	control.Write([]byte{iperf3ParamExchange})
+
+	var first [1]byte
+	if _, err := io.ReadFull(control, first[:]); err != nil {
+		f.count(&f.malformed)
+		return
+	}
+	if first[0] == iperf3ClientTerminate {
+		f.count(&f.probes)
+		return
+	}
+	var params iperf3Params
+	if err := readFakeIperf3JSON(control, first[0], &params); err != nil {
+		f.count(&f.malformed)
+		return
+	}
+
+	control.Write([]byte{iperf3CreateStreams})
+	counts := make([]uint64, params.Parallel)
+	streams := make([]net.Conn, params.Parallel)
+	for i := range streams {
+		if streams[i], _ = f.l.Accept(); streams[i] == nil {
+			return
+		}
+		defer streams[i].Close()
+		io.ReadFull(streams[i], make([]byte, iperf3CookieSize))
+	}
+	start := time.Now()
+	for i, s := range streams {
+		go func(s net.Conn, n *uint64) {
+			buf := make([]byte, 32*1024)
+			for {
+				var moved int
+				var err error
+				if params.Reverse {
+					moved, err = s.Write(buf)
+				} else {
+					moved, err = s.Read(buf)
+				}
+				atomic.AddUint64(n, uint64(moved))
+				if err != nil {
+					return
+				}
+			}
+		}(s, &counts[i])
+	}
+	control.Write([]byte{iperf3TestStart, iperf3TestRunning})
+
+	var state [1]byte
+	if _, err := io.ReadFull(control, state[:]); err != nil || state[0] != iperf3TestEnd {
+		return
+	}
+	elapsed := time.Since(start).Seconds()
+	control.Write([]byte{iperf3ExchangeResults})
+	var client iperf3Results
+	if err := readIperf3JSON(control, &client); err != nil {
+		return
+	}
+	if f.huge {
+		binary.Write(control, binary.BigEndian, uint32(3<<30))
+		return
+	}
+
+	var results iperf3Results
+	f.mu.Lock()
+	f.received = nil
+	for i := range counts {
+		n := atomic.LoadUint64(&counts[i])
+		if !params.Reverse {
+			f.received = append(f.received, n)
+		}
+		results.Streams = append(results.Streams, iperf3StreamResult{ID: iperf3StreamID(i), Bytes: n, EndTime: elapsed})
+	}
+	f.mu.Unlock()
+	writeIperf3JSON(control, results)
+	control.Write([]byte{iperf3DisplayResults})
+	io.ReadFull(control, state[:])
+}
+
+// readFakeIperf3JSON reads a JSON message whose length starts with first.
+func readFakeIperf3JSON(r io.Reader, first byte, v interface{}) error {
+	var rest [3]byte
+	if _, err := io.ReadFull(r, rest[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32([]byte{first, rest[0], rest[1], rest[2]})
+	return json.NewDecoder(io.LimitReader(r, int64(size))).Decode(v)
+}
+
+func TestIperf3RoundTrip(t *testing.T) {
+	f := startFakeIperf3(t, &fakeIperf3{})
+	backend := NewIperf3Backend(f.l.Addr().String())
+	ctx := context.Background()
+
+	down, err := backend.Download(ctx, testOptions(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(down.Streams) != 2 || down.Bytes == 0 {
+		t.Errorf("Download = %+v, want two streams that moved data", down)
+	}
+
+	up, err := backend.Upload(ctx, testOptions(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	received := f.received
+	f.mu.Unlock()
+	if len(up.Streams) != 2 || up.Streams[0].Bytes != received[0] || up.Streams[1].Bytes != received[1] {
+		t.Errorf("Upload streams = %+v, want what the server received, %v", up.Streams, received)
+	}
+}
+
+func TestIperf3Latency(t *testing.T) {
+	f := startFakeIperf3(t, &fakeIperf3{})
+	backend := NewIperf3Backend(f.l.Addr().String())
+
+	samples, lost, err := backend.Latency(context.Background(), 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 3 || lost != 0 {
+		t.Errorf("Latency = %v with %d lost, want 3 samples", samples, lost)
+	}
+	// the last probe may still be being read.
+	time.Sleep(50 * time.Millisecond)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.probes != 3 || f.malformed != 0 {
+		t.Errorf("server saw %d probes and %d malformed sessions, want 3 and 0", f.probes, f.malformed)
+	}
+}
+
+func TestIperf3Errors(t *testing.T) {
+	busy := startFakeIperf3(t, &fakeIperf3{deny: true})
+	_, err := NewIperf3Backend(busy.l.Addr().String()).Download(context.Background(), testOptions(1))
+	if err == nil || err.Error() != "iperf3 server is busy" {
+		t.Errorf("Download from a busy server = %v, want it to be busy", err)
+	}
+	samples, _, err := NewIperf3Backend(busy.l.Addr().String()).Latency(context.Background(), 1, 0)
+	if err != nil || len(samples) != 1 {
+		t.Errorf("Latency to a busy server = %v, %v, want a sample", samples, err)
+	}
+
+	huge := startFakeIperf3(t, &fakeIperf3{huge: true})
+	_, err = NewIperf3Backend(huge.l.Addr().String()).Upload(context.Background(), testOptions(1))
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("Upload with huge results = %v, want it to be too large", err)
+	}
+}
@@ -0,0 +1,111 @@
+package speedtest
+
+import (
+	"sort"
+	"time"
+)
+
+// LatencyStats summarises a set of round trip time samples.
+type LatencyStats struct {
+	// Samples holds every round trip time in the order it was measured.
+	Samples []time.Duration
+
+	Min    time.Duration
+	Max    time.Duration
+	Mean   time.Duration
+	Median time.Duration
+	P95    time.Duration
+
+	// Jitter is the mean absolute difference between consecutive samples.
+	Jitter time.Duration
+
+	// Lost is the number of probes that timed out without a reply.
+	Lost int
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func newLatencyStats(samples []time.Duration, lost int) LatencyStats {
+	stats := LatencyStats{Samples: samples, Lost: lost}
+	if len(samples) == 0 {
+		return stats
+	}
+
+	var sum, diffs time.Duration
+	for i, s := range samples {
+		sum += s
+		if i > 0 {
+			diff := s - samples[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			diffs += diff
+		}
+	}
+	stats.Mean = sum / time.Duration(len(samples))
+	if len(samples) > 1 {
+		stats.Jitter = diffs / time.Duration(len(samples)-1)
+	}
+
+	sorted := make(durations, len(samples))
+	copy(sorted, samples)
+	sort.Sort(sorted)
+	stats.Min = sorted[0]
+	stats.Max = sorted[len(sorted)-1]
+	stats.Median = sorted[len(sorted)/2]
+	stats.P95 = sorted[(len(sorted)*95+99)/100-1]
+
+	return stats
+}
+
+// gradeBufferbloat grades the latency added by a loaded link from A+ (barely
+// noticeable) to F (unusable for interactive traffic).
+func gradeBufferbloat(added time.Duration) string {
+	switch {
+	case added < 5*time.Millisecond:
+		return "A+"
+	case added < 30*time.Millisecond:
+		return "A"
+	case added < 60*time.Millisecond:
+		return "B"
+	case added < 200*time.Millisecond:
+		return "C"
+	case added < 400*time.Millisecond:
+		return "D"
+	default:
+		return "F"
+	}
+}
+
+// wait sleeps for d, returning false if stop is closed first.
+func wait(d time.Duration, stop <-chan struct{}) bool {
+	if stopped(stop) {
+		return false
+	}
+	if d <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// stopped reports whether stop has been closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
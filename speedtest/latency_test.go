@@ -0,0 +1,66 @@
+package speedtest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ms(n ...int) []time.Duration {
+	var d []time.Duration
+	for _, v := range n {
+		d = append(d, time.Duration(v)*time.Millisecond)
+	}
+	return d
+}
+
+func TestNewLatencyStats(t *testing.T) {
+	var ramp []int
+	for i := 1; i <= 20; i++ {
+		ramp = append(ramp, i)
+	}
+
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		lost    int
+		want    LatencyStats
+	}{
+		{
+			name: "no samples",
+			lost: 3,
+			want: LatencyStats{Lost: 3},
+		},
+		{
+			name:    "one sample has no jitter",
+			samples: ms(5),
+			want:    LatencyStats{Min: 5 * time.Millisecond, Max: 5 * time.Millisecond, Mean: 5 * time.Millisecond, Median: 5 * time.Millisecond, P95: 5 * time.Millisecond},
+		},
+		{
+			name:    "jitter follows the order measured",
+			samples: ms(30, 10, 20),
+			lost:    1,
+			want:    LatencyStats{Min: 10 * time.Millisecond, Max: 30 * time.Millisecond, Mean: 20 * time.Millisecond, Median: 20 * time.Millisecond, P95: 30 * time.Millisecond, Jitter: 15 * time.Millisecond, Lost: 1},
+		},
+		{
+			name:    "even count takes the upper median",
+			samples: ms(10, 20, 30, 40),
+			want:    LatencyStats{Min: 10 * time.Millisecond, Max: 40 * time.Millisecond, Mean: 25 * time.Millisecond, Median: 30 * time.Millisecond, P95: 40 * time.Millisecond, Jitter: 10 * time.Millisecond},
+		},
+		{
+			name:    "p95 of twenty is the nineteenth",
+			samples: ms(ramp...),
+			want:    LatencyStats{Min: 1 * time.Millisecond, Max: 20 * time.Millisecond, Mean: 10500 * time.Microsecond, Median: 11 * time.Millisecond, P95: 19 * time.Millisecond, Jitter: 1 * time.Millisecond},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.want.Samples = test.samples
+			got := newLatencyStats(test.samples, test.lost)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("newLatencyStats(%v, %d) = %+v, want %+v", test.samples, test.lost, got, test.want)
+			}
+		})
+	}
+}
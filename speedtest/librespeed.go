@@ -0,0 +1,187 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	// LibreSpeed's garbage.php serves its download in chunks of this size.
+	libreSpeedChunkSize = 1024 * 1024
+
+	libreSpeedDefaultChunks = 4
+	libreSpeedMaxChunks     = 1024
+
+	// libreSpeedMaxDownloadStep caps each download request at 64 chunks.
+	libreSpeedMaxDownloadStep = 6
+)
+
+// NewLibreSpeedBackend creates a Backend that tests against the LibreSpeed
+// backend at base, the URL of the directory holding its garbage.php,
+// empty.php and getIP.php.
+func NewLibreSpeedBackend(base string) (Backend, error) {
+	return newLibreSpeedBackend(base, &dialer{})
+}
+
+func newLibreSpeedBackend(base string, d *dialer) (Backend, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || u.Path[len(u.Path)-1] != '/' {
+		u.Path += "/"
+	}
+
+	return &httpBackend{
+		client: newHTTPClient(d),
+		server: ServerInfo{Host: u.Host, Location: u.String()},
+		downloadURL: func(step int) string {
+			return resolve(u, fmt.Sprintf("garbage.php?ckSize=%d&r=%d", 1<<uint(step), rand.Int63()))
+		},
+		maxDownloadStep: libreSpeedMaxDownloadStep,
+		uploadURL:       resolve(u, "empty.php"),
+		latencyURL: func() string {
+			return resolve(u, fmt.Sprintf("empty.php?r=%d", rand.Int63()))
+		},
+	}, nil
+}
+
+// libreSpeedIP is the response from a LibreSpeed getIP.php.
+type libreSpeedIP struct {
+	ProcessedString string `json:"processedString"`
+}
+
+// closestLibreSpeedServer returns a Backend for whichever of the LibreSpeed
+// backends at bases has the lowest latency.
+func closestLibreSpeedServer(ctx context.Context, bases []string, d *dialer) (Backend, error) {
+	var best Backend
+	var bestLatency time.Duration
+	for _, base := range bases {
+		backend, err := newLibreSpeedBackend(base, d)
+		if err != nil {
+			return nil, err
+		}
+
+		samples, _, err := backend.Latency(ctx, 3, 0)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil && len(samples) == 0 {
+			err = fmt.Errorf("ping timed out")
+		}
+		if err != nil {
+			log.Printf("failed to connect to %s, trying another. Error: %s", base, err)
+			continue
+		}
+
+		latency := newLatencyStats(samples, 0).Median
+		if best == nil || latency < bestLatency {
+			best, bestLatency = backend, latency
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no available LibreSpeed servers")
+	}
+
+	if ip, err := libreSpeedClientIP(ctx, best.(*httpBackend)); err == nil {
+		log.Printf("LibreSpeed server %s sees us as %s", best.Server().Location, ip)
+	}
+	return best, nil
+}
+
+// libreSpeedClientIP asks a LibreSpeed backend what our IP address is.
+func libreSpeedClientIP(ctx context.Context, b *httpBackend) (string, error) {
+	base, err := url.Parse(b.server.Location)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", resolve(base, "getIP.php"), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var ip libreSpeedIP
+	if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+		return "", err
+	}
+	return ip.ProcessedString, nil
+}
+
+// libreSpeedHandler serves the LibreSpeed backend endpoints.
+type libreSpeedHandler struct {
+	garbage []byte
+}
+
+// NewLibreSpeedHandler returns an http.Handler serving LibreSpeed's
+// garbage.php, empty.php and getIP.php endpoints from any directory, so that
+// browsers running the LibreSpeed frontend and speedtestdog agents using the
+// librespeed backend can share a test target.
+func NewLibreSpeedHandler() http.Handler {
+	garbage := make([]byte, libreSpeedChunkSize)
+	rand.New(rand.NewSource(time.Now().UnixNano())).Read(garbage)
+	return &libreSpeedHandler{garbage: garbage}
+}
+
+func (h *libreSpeedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("Access-Control-Allow-Methods", "GET, POST")
+	header.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	if r.Method == "OPTIONS" {
+		header.Set("Access-Control-Allow-Headers", "Content-Encoding, Content-Type")
+		return
+	}
+
+	switch path.Base(r.URL.Path) {
+	case "garbage.php":
+		h.serveGarbage(w, r)
+	case "empty.php":
+		io.Copy(ioutil.Discard, r.Body)
+		header.Set("Connection", "keep-alive")
+	case "getIP.php":
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		header.Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(libreSpeedIP{ProcessedString: host})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveGarbage writes ckSize chunks of incompressible data.
+func (h *libreSpeedHandler) serveGarbage(w http.ResponseWriter, r *http.Request) {
+	chunks := libreSpeedDefaultChunks
+	if n, err := strconv.Atoi(r.URL.Query().Get("ckSize")); err == nil && n > 0 {
+		chunks = n
+	}
+	if chunks > libreSpeedMaxChunks {
+		chunks = libreSpeedMaxChunks
+	}
+
+	header := w.Header()
+	header.Set("Content-Description", "File Transfer")
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Disposition", "attachment; filename=random.dat")
+	header.Set("Content-Transfer-Encoding", "binary")
+	header.Set("Content-Length", strconv.Itoa(chunks*libreSpeedChunkSize))
+	for i := 0; i < chunks; i++ {
+		if _, err := w.Write(h.garbage); err != nil {
+			return
+		}
+	}
+}
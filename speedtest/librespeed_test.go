@@ -0,0 +1,110 @@
+package speedtest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLibreSpeedHandler(t *testing.T) {
+	server := httptest.NewServer(NewLibreSpeedHandler())
+	defer server.Close()
+
+	tests := []struct {
+		method, path string
+		status       int
+		size         int
+	}{
+		{method: "GET", path: "/backend/garbage.php?ckSize=2", status: 200, size: 2 * libreSpeedChunkSize},
+		{method: "GET", path: "/garbage.php", status: 200, size: libreSpeedDefaultChunks * libreSpeedChunkSize},
+		{method: "GET", path: "/garbage.php?ckSize=junk", status: 200, size: libreSpeedDefaultChunks * libreSpeedChunkSize},
+		{method: "POST", path: "/backend/empty.php", status: 200},
+		{method: "OPTIONS", path: "/backend/empty.php", status: 200},
+		{method: "GET", path: "/backend/nothing.php", status: 404, size: -1},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.path, resp.StatusCode, test.status)
+		}
+		if test.size >= 0 && len(body) != test.size {
+			t.Errorf("%s %s: %d bytes, want %d", test.method, test.path, len(body), test.size)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("%s %s: Access-Control-Allow-Origin = %q, want *", test.method, test.path, got)
+		}
+	}
+}
+
+func TestLibreSpeedRoundTrip(t *testing.T) {
+	server := httptest.NewServer(NewLibreSpeedHandler())
+	defer server.Close()
+
+	backend, err := NewLibreSpeedBackend(server.URL + "/backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for name, transfer := range map[string]func(context.Context, TransferOptions) (*Transfer, error){
+		"download": backend.Download,
+		"upload":   backend.Upload,
+	} {
+		got, err := transfer(ctx, testOptions(2))
+		if err != nil {
+			t.Errorf("%s failed: %s", name, err)
+			continue
+		}
+		if len(got.Streams) != 2 || got.Bytes == 0 || got.Speed <= 0 {
+			t.Errorf("%s = %+v, want two streams that moved data", name, got)
+		}
+	}
+
+	samples, lost, err := backend.Latency(ctx, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 3 || lost != 0 {
+		t.Errorf("Latency = %v with %d lost, want 3 samples", samples, lost)
+	}
+}
+
+func TestClosestLibreSpeedServer(t *testing.T) {
+	server := httptest.NewServer(NewLibreSpeedHandler())
+	defer server.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	backend, err := closestLibreSpeedServer(context.Background(), []string{down.URL, server.URL + "/backend/"}, &dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backend.Server().Location, server.URL+"/backend/"; got != want {
+		t.Errorf("closest server = %s, want %s", got, want)
+	}
+	ip, err := libreSpeedClientIP(context.Background(), backend.(*httpBackend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "127.0.0.1" {
+		t.Errorf("client IP = %q, want 127.0.0.1", ip)
+	}
+
+	if _, err := closestLibreSpeedServer(context.Background(), []string{down.URL}, &dialer{}); err == nil {
+		t.Error("closestLibreSpeedServer with no live servers succeeded")
+	}
+}
@@ -0,0 +1,43 @@
+package speedtest
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter paces I/O to a fixed rate. A nil limiter never waits. It is safe for
+// concurrent use, in which case the rate is shared between its users.
+type limiter struct {
+	mu sync.Mutex
+
+	// bytesPerSec is the rate to pace to.
+	bytesPerSec float64
+
+	// free is when the bytes allowed so far will have been used up.
+	free time.Time
+}
+
+func newLimiter(rate Speed) *limiter {
+	if rate == 0 {
+		return nil
+	}
+	return &limiter{bytesPerSec: float64(rate) / 8}
+}
+
+// wait blocks until n more bytes may be moved.
+func (l *limiter) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.free.Before(now) {
+		l.free = now
+	}
+	l.free = l.free.Add(time.Duration(float64(n) / l.bytesPerSec * float64(time.Second)))
+	delay := l.free.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
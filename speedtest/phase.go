@@ -0,0 +1,91 @@
+package speedtest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Phase is one of the measurements that make up a speed test.
+type Phase string
+
+const (
+	PhaseDownload Phase = "download"
+	PhaseUpload   Phase = "upload"
+	PhasePing     Phase = "ping"
+	PhaseUDP      Phase = "udp"
+	PhaseDNS      Phase = "dns"
+	PhaseHTTP     Phase = "http"
+	PhaseICMP     Phase = "icmp"
+	PhasePathMTU  Phase = "pathMTU"
+)
+
+// AllPhases are every phase, in the order a test runs them. The probes only
+// run if they are configured as well.
+var AllPhases = []Phase{
+	PhaseDownload,
+	PhaseUpload,
+	PhasePing,
+	PhaseUDP,
+	PhaseDNS,
+	PhaseHTTP,
+	PhaseICMP,
+	PhasePathMTU,
+}
+
+// ParsePhases parses a comma-separated list of phases, such as
+// "download,upload,ping".
+func ParsePhases(s string) ([]Phase, error) {
+	var phases []Phase
+	for _, name := range strings.Split(s, ",") {
+		phase := Phase(strings.TrimSpace(name))
+		if phase == "" {
+			continue
+		}
+		if !phase.valid() {
+			return nil, fmt.Errorf("unknown phase %q", phase)
+		}
+		phases = append(phases, phase)
+	}
+	return phases, nil
+}
+
+func (p Phase) valid() bool {
+	for _, phase := range AllPhases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePhases checks that every one of phases is known.
+func validatePhases(phases []Phase) error {
+	for _, phase := range phases {
+		if !phase.valid() {
+			return fmt.Errorf("unknown phase %q", phase)
+		}
+	}
+	return nil
+}
+
+// TransfersIn reports whether phases include a download or upload, which
+// account for nearly all of a test's data.
+func TransfersIn(phases []Phase) bool {
+	for _, phase := range phases {
+		if phase == PhaseDownload || phase == PhaseUpload {
+			return true
+		}
+	}
+	return false
+}
+
+// WithoutTransfers returns phases without the download and upload.
+func WithoutTransfers(phases []Phase) []Phase {
+	var rest []Phase
+	for _, phase := range phases {
+		if phase != PhaseDownload && phase != PhaseUpload {
+			rest = append(rest, phase)
+		}
+	}
+	return rest
+}
@@ -0,0 +1,52 @@
+package speedtest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePhases(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []Phase
+		err  bool
+	}{
+		{in: "", want: nil},
+		{in: "download", want: []Phase{PhaseDownload}},
+		{in: "download,upload,ping", want: []Phase{PhaseDownload, PhaseUpload, PhasePing}},
+		{in: " ping , pathMTU ", want: []Phase{PhasePing, PhasePathMTU}},
+		{in: "udp,,dns,", want: []Phase{PhaseUDP, PhaseDNS}},
+		{in: "download,bogus", err: true},
+		{in: "Download", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParsePhases(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParsePhases(%q) = %v, want an error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePhases(%q) failed: %s", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParsePhases(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestWithoutTransfers(t *testing.T) {
+	got := WithoutTransfers(AllPhases)
+	if TransfersIn(got) {
+		t.Errorf("WithoutTransfers(AllPhases) = %v still has transfers", got)
+	}
+	if len(got) != len(AllPhases)-2 {
+		t.Errorf("WithoutTransfers(AllPhases) = %v, want all but two", got)
+	}
+	if got := WithoutTransfers([]Phase{PhaseDownload}); len(got) != 0 {
+		t.Errorf("WithoutTransfers([download]) = %v, want none", got)
+	}
+}
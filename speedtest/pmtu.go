@@ -0,0 +1,49 @@
+package speedtest
+
+import (
+	"context"
+	"strconv"
+)
+
+const (
+	// minPathMTU4 and minPathMTU6 are the smallest MTUs probed, which every
+	// IPv4 and IPv6 path is expected to carry.
+	minPathMTU4 = 576
+	minPathMTU6 = 1280
+
+	// maxPathMTU is the size of the largest IP packet.
+	maxPathMTU = 65535
+
+	// pmtuAttempts is how many probes of each size are sent before deciding
+	// that packets of that size are being dropped.
+	pmtuAttempts = 2
+)
+
+// PathMTU is the largest packet that can reach the server unfragmented.
+type PathMTU struct {
+	// MTU is the size of the largest probe that reached the server.
+	MTU int
+
+	// LinkMTU is the MTU the kernel assumed for the route to the server
+	// before probing.
+	LinkMTU int
+
+	// BlackHole is set when probes too big for the path were dropped without
+	// an ICMP "fragmentation needed" reply, which stalls TCP connections
+	// whenever they send full-sized packets.
+	BlackHole bool
+}
+
+// Tag is the tag attached to a Result's metrics for p.
+func (p *PathMTU) Tag() string {
+	return "speedtest.path_mtu:" + strconv.Itoa(p.MTU)
+}
+
+// discoverPathMTU finds the path MTU to host, which may include a port.
+func discoverPathMTU(ctx context.Context, d *dialer, host string) (*PathMTU, error) {
+	ip, err := d.lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return pathMTU(ctx, d, ip)
+}
@@ -0,0 +1,134 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// pathMTU searches for the path MTU to ip by sending UDP probes with the
+// don't fragment bit set, starting from the MTU of the route to ip, until it
+// finds the largest size that the destination answers.
+func pathMTU(ctx context.Context, d *dialer, ip net.IP) (*PathMTU, error) {
+	t, err := newTracer(d, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(t.fd)
+
+	discoverOpt, probe, minMTU := syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE, minPathMTU4
+	if t.v6 {
+		discoverOpt, probe, minMTU = syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE, minPathMTU6
+	}
+	// probe mode sets the don't fragment bit but sends packets bigger than
+	// the kernel's idea of the path MTU anyway.
+	if err := syscall.SetsockoptInt(t.fd, t.level, discoverOpt, probe); err != nil {
+		return nil, err
+	}
+
+	linkMTU, err := routeMTU(d, t)
+	if err != nil {
+		return nil, err
+	}
+	result := &PathMTU{LinkMTU: linkMTU}
+
+	port := traceroutePort
+	// fits reports whether a probe of size bytes reached ip, and if not,
+	// the MTU the path reported, or whether the probes vanished.
+	fits := func(size int) (ok bool, hint int, silent bool, err error) {
+		for i := 0; i < pmtuAttempts; i++ {
+			if ctx.Err() != nil {
+				return false, 0, false, ctx.Err()
+			}
+			port++
+			reply, err := t.probe(port, size)
+			if err != nil {
+				return false, 0, false, err
+			}
+			switch {
+			case reply == nil:
+				continue
+			case reply.errno == syscall.EMSGSIZE:
+				return false, int(reply.info), false, nil
+			case reply.from != nil && reply.from.Equal(ip):
+				return true, 0, false, nil
+			default:
+				return false, 0, false, fmt.Errorf("probe rejected by %s: %s", reply.from, reply.errno)
+			}
+		}
+		return false, 0, true, nil
+	}
+
+	hi := linkMTU
+	if hi > maxPathMTU {
+		hi = maxPathMTU
+	}
+	ok, hint, silent, err := fits(hi)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		result.MTU = hi
+		return result, nil
+	}
+	result.BlackHole = silent
+
+	lo := minMTU
+	loOK, _, loSilent, err := fits(lo)
+	if err != nil {
+		return nil, err
+	}
+	if loSilent {
+		return nil, fmt.Errorf("%s didn't answer any probes", ip)
+	}
+	if !loOK {
+		return nil, fmt.Errorf("even %d byte probes to %s don't fit", lo, ip)
+	}
+
+	// lo always fits and hi never does.
+	for {
+		if hint > lo && hint < hi {
+			hi = hint + 1
+		}
+		if hi-lo <= 1 {
+			break
+		}
+		mid := (lo + hi) / 2
+		ok, hint, silent, err = fits(mid)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			lo = mid
+			continue
+		}
+		hi = mid
+		result.BlackHole = result.BlackHole || silent
+	}
+	result.MTU = lo
+	return result, nil
+}
+
+// routeMTU asks the kernel for the MTU of the route to t's destination,
+// which is the link's MTU unless an earlier ICMP reply lowered it.
+func routeMTU(d *dialer, t *tracer) (int, error) {
+	family, mtuOpt := syscall.AF_INET, syscall.IP_MTU
+	if t.v6 {
+		family, mtuOpt = syscall.AF_INET6, syscall.IPV6_MTU
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_UDP)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(fd)
+	if err := d.bindFD(fd, t.v6); err != nil {
+		return 0, err
+	}
+
+	// the route is only looked up once the socket is connected.
+	if err := syscall.Connect(fd, t.sockaddr(traceroutePort)); err != nil {
+		return 0, err
+	}
+	return syscall.GetsockoptInt(fd, t.level, mtuOpt)
+}
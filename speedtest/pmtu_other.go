@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+func pathMTU(ctx context.Context, d *dialer, ip net.IP) (*PathMTU, error) {
+	return nil, fmt.Errorf("path MTU discovery is only supported on Linux")
+}
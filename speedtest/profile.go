@@ -0,0 +1,50 @@
+package speedtest
+
+import "fmt"
+
+// Profile is a named variation of a Config, such as a quick single-stream
+// test or a thorough one under load. Fields left empty keep the Config's
+// value.
+type Profile struct {
+	// Duration is how long each of the download and upload runs. Zero means
+	// the scheduler's default.
+	Duration Duration `json:"duration,omitempty"`
+
+	Streams           int      `json:"streams,omitempty"`
+	Server            string   `json:"server,omitempty"`
+	LibreSpeedServers []string `json:"libreSpeedServers,omitempty"`
+	Phases            []Phase  `json:"phases,omitempty"`
+
+	// LoadedLatency is a pointer so that a profile can turn it off.
+	LoadedLatency *bool `json:"loadedLatency,omitempty"`
+}
+
+// Profile returns a copy of c with the named profile applied, or c itself if
+// name is empty.
+func (c *Config) Profile(name string) (*Config, error) {
+	if name == "" {
+		return c, nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+
+	profiled := *c
+	if p.Streams > 0 {
+		profiled.Streams = p.Streams
+	}
+	if p.Server != "" {
+		profiled.Server = p.Server
+	}
+	if len(p.LibreSpeedServers) > 0 {
+		profiled.LibreSpeedServers = p.LibreSpeedServers
+	}
+	if len(p.Phases) > 0 {
+		profiled.Phases = p.Phases
+	}
+	if p.LoadedLatency != nil {
+		profiled.LoadedLatency = *p.LoadedLatency
+	}
+	return &profiled, nil
+}
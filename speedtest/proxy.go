@@ -0,0 +1,220 @@
+package speedtest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants, from RFC 1928 and RFC 1929.
+const (
+	socks5Version      = 5
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5CmdConnect   = 1
+	socks5AddrIPv4     = 1
+	socks5AddrDomain   = 3
+	socks5AddrIPv6     = 4
+	socks5Succeeded    = 0
+)
+
+var socks5Replies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// parseProxy parses a proxy URL, which is socks5://host:port or
+// http://host:port, with optional user:password@ credentials.
+func parseProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %s", raw, err)
+	}
+	switch u.Scheme {
+	case "socks5", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected socks5 or http", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy %q has no port", raw)
+	}
+	return u, nil
+}
+
+// tunnel asks the proxy that conn is connected to for a tunnel to addr,
+// giving up once ctx is done or timeout passes.
+func (d *dialer) tunnel(ctx context.Context, conn net.Conn, addr string, timeout time.Duration) error {
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	var err error
+	if d.proxy.Scheme == "socks5" {
+		err = socks5Connect(conn, d.proxy.User, addr)
+	} else {
+		err = httpConnect(conn, d.proxy.User, addr)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("proxy %s: %s", d.proxy.Host, err)
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// socks5Connect opens a SOCKS5 tunnel to addr over conn.
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 0xffff {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+
+	method := byte(socks5AuthNone)
+	if user != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] != method {
+		return fmt.Errorf("no acceptable authentication method")
+	}
+
+	if method == socks5AuthPassword {
+		name := user.Username()
+		password, _ := user.Password()
+		if len(name) > 255 || len(password) > 255 {
+			return fmt.Errorf("SOCKS username and password must be at most 255 bytes")
+		}
+		req := []byte{1, byte(len(name))}
+		req = append(req, name...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("SOCKS authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q is too long", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[1] != socks5Succeeded {
+		if msg, ok := socks5Replies[header[1]]; ok {
+			return fmt.Errorf("connecting to %s: %s", addr, msg)
+		}
+		return fmt.Errorf("connecting to %s: SOCKS reply %d", addr, header[1])
+	}
+
+	// skip the address the proxy connected from.
+	var skip int
+	switch header[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("unknown SOCKS address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// httpConnect opens an HTTP CONNECT tunnel to addr over conn.
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{"User-Agent": {userAgent}},
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// the response is read a byte at a time, so that none of the tunnelled
+	// data is buffered away from conn.
+	resp, err := http.ReadResponse(bufio.NewReaderSize(byteReader{conn}, 16), req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("connecting to %s: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// byteReader reads at most one byte at a time from r.
+type byteReader struct {
+	r io.Reader
+}
+
+func (b byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return b.r.Read(p)
+}
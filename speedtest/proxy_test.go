@@ -0,0 +1,286 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// socks5Step is one request a fake SOCKS5 proxy expects, and its reply.
+type socks5Step struct {
+	want, reply []byte
+}
+
+// fakeSOCKS5 plays the proxy's side of steps over conn, returning the first
+// request that didn't match.
+func fakeSOCKS5(conn net.Conn, steps []socks5Step) error {
+	for _, step := range steps {
+		got := make([]byte, len(step.want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			return err
+		}
+		if !bytes.Equal(got, step.want) {
+			return fmt.Errorf("got request %v, want %v", got, step.want)
+		}
+		// the client may stop reading after a failure reply.
+		conn.Write(step.reply)
+	}
+	return nil
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	succeeded := []byte{5, 0, 0, 1, 10, 0, 0, 1, 0x1f, 0x90}
+
+	tests := []struct {
+		name  string
+		user  *url.Userinfo
+		addr  string
+		steps []socks5Step
+		err   string
+	}{
+		{
+			name: "IPv4 without auth",
+			addr: "192.0.2.1:8080",
+			steps: []socks5Step{
+				{want: []byte{5, 1, 0}, reply: []byte{5, 0}},
+				{want: []byte{5, 1, 0, 1, 192, 0, 2, 1, 0x1f, 0x90}, reply: succeeded},
+			},
+		},
+		{
+			name: "domain",
+			addr: "example.com:443",
+			steps: []socks5Step{
+				{want: []byte{5, 1, 0}, reply: []byte{5, 0}},
+				{want: append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 1, 0xbb), reply: succeeded},
+			},
+		},
+		{
+			name: "IPv6 bound to a domain",
+			addr: "[2001:db8::1]:80",
+			steps: []socks5Step{
+				{want: []byte{5, 1, 0}, reply: []byte{5, 0}},
+				{
+					want:  []byte{5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80},
+					reply: append(append([]byte{5, 0, 0, 3, 5}, "proxy"...), 0, 80),
+				},
+			},
+		},
+		{
+			name: "password",
+			user: url.UserPassword("bob", "secret"),
+			addr: "192.0.2.1:80",
+			steps: []socks5Step{
+				{want: []byte{5, 1, 2}, reply: []byte{5, 2}},
+				{want: append(append([]byte{1, 3}, "bob"...), append([]byte{6}, "secret"...)...), reply: []byte{1, 0}},
+				{want: []byte{5, 1, 0, 1, 192, 0, 2, 1, 0, 80}, reply: succeeded},
+			},
+		},
+		{
+			name: "wrong password",
+			user: url.UserPassword("bob", "wrong"),
+			addr: "192.0.2.1:80",
+			steps: []socks5Step{
+				{want: []byte{5, 1, 2}, reply: []byte{5, 2}},
+				{want: append(append([]byte{1, 3}, "bob"...), append([]byte{5}, "wrong"...)...), reply: []byte{1, 1}},
+			},
+			err: "SOCKS authentication failed",
+		},
+		{
+			name: "no acceptable method",
+			addr: "192.0.2.1:80",
+			steps: []socks5Step{
+				{want: []byte{5, 1, 0}, reply: []byte{5, 0xff}},
+			},
+			err: "no acceptable authentication method",
+		},
+		{
+			name: "refused",
+			addr: "192.0.2.1:80",
+			steps: []socks5Step{
+				{want: []byte{5, 1, 0}, reply: []byte{5, 0}},
+				{want: []byte{5, 1, 0, 1, 192, 0, 2, 1, 0, 80}, reply: []byte{5, 5, 0, 1}},
+			},
+			err: "connecting to 192.0.2.1:80: connection refused",
+		},
+		{
+			name: "not SOCKS5",
+			addr: "192.0.2.1:80",
+			steps: []socks5Step{
+				{want: []byte{5, 1, 0}, reply: []byte{4, 0}},
+			},
+			err: "unexpected SOCKS version 4",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, proxy := net.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				done <- fakeSOCKS5(proxy, test.steps)
+				proxy.Close()
+			}()
+
+			err := socks5Connect(client, test.user, test.addr)
+			client.Close()
+			if proxyErr := <-done; proxyErr != nil {
+				t.Errorf("proxy: %s", proxyErr)
+			}
+			if test.err == "" && err != nil {
+				t.Errorf("socks5Connect failed: %s", err)
+			}
+			if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Errorf("socks5Connect = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+// fakeHTTPProxy forwards plain HTTP requests, and like most proxies, only
+// allows CONNECT to the ports it is told are for TLS.
+type fakeHTTPProxy struct {
+	tlsPorts []string
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (p *fakeHTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.requests = append(p.requests, r.Method+" "+r.RequestURI)
+	p.mu.Unlock()
+	if r.Header.Get("Proxy-Authorization") != "Basic Ym9iOnNlY3JldA==" {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method != "CONNECT" {
+		r.RequestURI = ""
+		r.Header.Del("Proxy-Authorization")
+		resp, err := (&http.Transport{}).RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	_, port, _ := net.SplitHostPort(r.Host)
+	allowed := false
+	for _, p := range p.tlsPorts {
+		allowed = allowed || p == port
+	}
+	if !allowed {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	defer origin.Close()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+	fake := &fakeHTTPProxy{tlsPorts: []string{echoPort}}
+	proxy := httptest.NewServer(fake)
+	defer proxy.Close()
+	d, err := newDialer(&Config{Proxy: strings.Replace(proxy.URL, "http://", "http://bob:secret@", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// plain HTTP is forwarded rather than tunnelled to a port the proxy
+	// won't CONNECT to.
+	client := &http.Client{Transport: &http.Transport{Proxy: d.httpProxy, DialContext: d.DialContext}}
+	resp, err := client.Get(origin.URL + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "hello from /test" {
+		t.Errorf("GET through the proxy = %s %q, want 200 OK", resp.Status, body)
+	}
+
+	// everything else is tunnelled.
+	conn, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("echo through the tunnel = %q, %v, want ping", buf, err)
+	}
+
+	want := []string{"GET " + origin.URL + "/test", "CONNECT " + echo.Addr().String()}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if !reflect.DeepEqual(fake.requests, want) {
+		t.Errorf("proxy saw %q, want %q", fake.requests, want)
+	}
+	if d.takeIPVersion() != 0 {
+		t.Error("a proxied connection recorded the IP version of the hop to the proxy")
+	}
+}
+
+func TestNewDialerProxyWithFamily(t *testing.T) {
+	for _, family := range []string{"v4", "v6"} {
+		if _, err := newDialer(&Config{Proxy: "socks5://127.0.0.1:1080", AddressFamily: family}); err == nil {
+			t.Errorf("newDialer with a proxy and address family %s succeeded", family)
+		}
+	}
+	if _, err := NewClientsContext(context.Background(), &Config{Proxy: "socks5://127.0.0.1:1080", AddressFamily: "both"}); err == nil {
+		t.Error(`NewClientsContext with a proxy and address family "both" succeeded`)
+	}
+}
@@ -0,0 +1,96 @@
+package speedtest
+
+import (
+	"fmt"
+	"time"
+)
+
+// Schedule runs a set of phases on its own interval, so that cheap phases can
+// run more often than a full test.
+type Schedule struct {
+	// Name identifies the schedule in logs and in the
+	// speedtest.schedule tag of its metrics.
+	Name string `json:"name"`
+
+	// Interval is the time between the starts of successive tests.
+	Interval Duration `json:"interval"`
+
+	// Phases are the phases each test runs. Empty means those of the
+	// test's profile.
+	Phases []Phase `json:"phases,omitempty"`
+
+	// Profiles are the names of the Config.Profiles the schedule's tests
+	// use, taking turns, so that a schedule can rotate between them. Empty
+	// means the Config itself.
+	Profiles []string `json:"profiles,omitempty"`
+
+	// From and To, if set, limit the schedule to the local times of day
+	// between them, such as "01:00" and "05:00". The window wraps around
+	// midnight if To is earlier than From, and covers the whole day if they
+	// are the same.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// Profile is the name of the profile the schedule's nth test uses, or empty
+// for the Config itself.
+func (s Schedule) Profile(n int) string {
+	if len(s.Profiles) == 0 {
+		return ""
+	}
+	return s.Profiles[n%len(s.Profiles)]
+}
+
+// Active reports whether now is within the schedule's window. It is always
+// true if the schedule has none, or one that starts when it ends.
+func (s Schedule) Active(now time.Time) bool {
+	if s.From == "" && s.To == "" {
+		return true
+	}
+	// validateSchedules has already checked these.
+	from, _ := parseTimeOfDay(s.From)
+	to, _ := parseTimeOfDay(s.To)
+	at := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+
+	if from == to {
+		return true
+	}
+	if from < to {
+		return at >= from && at < to
+	}
+	return at >= from || at < to
+}
+
+// parseTimeOfDay parses a time of day such as "15:04" into the time since
+// midnight. Empty means midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected such as 15:04", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// validateSchedules checks that config's schedules only use known phases and
+// profiles, and that their windows parse.
+func validateSchedules(config *Config) error {
+	for _, s := range config.Schedules {
+		if err := validatePhases(s.Phases); err != nil {
+			return fmt.Errorf("schedule %q: %s", s.Name, err)
+		}
+		for _, name := range s.Profiles {
+			if _, ok := config.Profiles[name]; !ok {
+				return fmt.Errorf("schedule %q: unknown profile %q", s.Name, name)
+			}
+		}
+		for _, t := range []string{s.From, s.To} {
+			if _, err := parseTimeOfDay(t); err != nil {
+				return fmt.Errorf("schedule %q: %s", s.Name, err)
+			}
+		}
+	}
+	return nil
+}
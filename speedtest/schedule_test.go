@@ -0,0 +1,77 @@
+package speedtest
+
+import (
+	"testing"
+	"time"
+)
+
+func at(hour, minute int) time.Time {
+	return time.Date(2020, 1, 1, hour, minute, 30, 0, time.Local)
+}
+
+func TestScheduleActive(t *testing.T) {
+	tests := []struct {
+		from, to string
+		now      time.Time
+		want     bool
+	}{
+		{from: "", to: "", now: at(12, 0), want: true},
+		{from: "01:00", to: "05:00", now: at(0, 59), want: false},
+		{from: "01:00", to: "05:00", now: at(1, 0), want: true},
+		{from: "01:00", to: "05:00", now: at(4, 59), want: true},
+		{from: "01:00", to: "05:00", now: at(5, 0), want: false},
+		{from: "23:00", to: "02:00", now: at(22, 59), want: false},
+		{from: "23:00", to: "02:00", now: at(23, 0), want: true},
+		{from: "23:00", to: "02:00", now: at(0, 0), want: true},
+		{from: "23:00", to: "02:00", now: at(1, 59), want: true},
+		{from: "23:00", to: "02:00", now: at(2, 0), want: false},
+		{from: "23:00", to: "02:00", now: at(12, 0), want: false},
+		{from: "22:00", to: "", now: at(23, 0), want: true},
+		{from: "22:00", to: "", now: at(0, 0), want: false},
+		{from: "", to: "06:00", now: at(5, 0), want: true},
+		{from: "", to: "06:00", now: at(7, 0), want: false},
+		{from: "06:00", to: "06:00", now: at(5, 59), want: true},
+		{from: "06:00", to: "06:00", now: at(6, 0), want: true},
+		{from: "06:00", to: "06:00", now: at(18, 0), want: true},
+	}
+
+	for _, test := range tests {
+		s := Schedule{From: test.from, To: test.to}
+		if got := s.Active(test.now); got != test.want {
+			t.Errorf("Schedule{From: %q, To: %q}.Active(%s) = %v, want %v", test.from, test.to, test.now.Format("15:04"), got, test.want)
+		}
+	}
+}
+
+func TestScheduleProfile(t *testing.T) {
+	s := Schedule{Profiles: []string{"quick", "thorough"}}
+	for n, want := range []string{"quick", "thorough", "quick", "thorough"} {
+		if got := s.Profile(n); got != want {
+			t.Errorf("Profile(%d) = %q, want %q", n, got, want)
+		}
+	}
+	if got := (Schedule{}).Profile(3); got != "" {
+		t.Errorf("Profile of a schedule without profiles = %q, want empty", got)
+	}
+}
+
+func TestValidateSchedules(t *testing.T) {
+	profiles := map[string]*Profile{"quick": {}}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		err      bool
+	}{
+		{name: "valid", schedule: Schedule{Name: "s", Phases: []Phase{PhasePing}, Profiles: []string{"quick"}, From: "23:00", To: "01:00"}},
+		{name: "unknown phase", schedule: Schedule{Name: "s", Phases: []Phase{"bogus"}}, err: true},
+		{name: "unknown profile", schedule: Schedule{Name: "s", Profiles: []string{"slow"}}, err: true},
+		{name: "invalid time", schedule: Schedule{Name: "s", From: "25:00"}, err: true},
+	}
+
+	for _, test := range tests {
+		config := &Config{Schedules: []Schedule{test.schedule}, Profiles: profiles}
+		if err := validateSchedules(config); (err != nil) != test.err {
+			t.Errorf("%s: validateSchedules = %v, want error %v", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package speedtest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serverGreeting = "HELLO 2.5 (2.5.4) 2018-03-15.0000.speedtestdog"
+
+	// serverBusy is sent in reply to a transfer beyond MaxConns.
+	serverBusy = "BUSY"
+
+	// busyLinger and maxBusyDrain bound how long, and how much of what the
+	// client sends, a busy connection is drained for before it is closed.
+	busyLinger   = 5 * time.Second
+	maxBusyDrain = 1024 * 1024
+
+	// serverIdleTimeout is how long a connection may sit without moving any
+	// data before it is closed.
+	serverIdleTimeout = 30 * time.Second
+
+	// maxRequestSize caps the size of a single DOWNLOAD or UPLOAD.
+	maxRequestSize = 128 * 1024 * 1024
+)
+
+// Server serves the speedtest.net TCP protocol, so that any speedtestdog agent
+// can run its tests against a host you control.
+type Server struct {
+	// Addr is the TCP address to listen on, such as ":8080".
+	Addr string
+
+	// MaxConns caps the number of connections downloading or uploading at
+	// once. A connection takes a slot with its first DOWNLOAD or UPLOAD, and
+	// one beyond the cap is told the server is busy and closed instead.
+	// Connections that only ping, such as a client's latency probes, aren't
+	// counted, so that they can't lock out the transfers they run alongside.
+	// Zero means no limit.
+	MaxConns int
+
+	// RateLimit caps the throughput in each direction of each client,
+	// shared between all of the client's connections. Zero means no limit.
+	RateLimit Speed
+
+	mu       sync.Mutex
+	slots    chan struct{}
+	limiters map[string]*clientLimiter
+}
+
+// clientLimiter is the pair of limiters shared by one client's connections.
+type clientLimiter struct {
+	down, up *limiter
+	refs     int
+}
+
+// ListenAndServe listens on s.Addr and serves connections until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve serves connections accepted from l until ctx is done, and then closes
+// l.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	slotted := false
+	defer func() {
+		if slotted {
+			s.release()
+		}
+	}()
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	limits := s.limiter(host)
+	defer s.releaseLimiter(host)
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(serverIdleTimeout))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if !slotted && isTransfer(line) {
+			if !s.acquire() {
+				refuse(conn)
+				return
+			}
+			slotted = true
+		}
+
+		if err := s.handle(conn, r, line, limits); err != nil {
+			// clients routinely hang up mid-transfer when their test
+			// ends, so only protocol errors are worth logging.
+			if _, ok := err.(net.Error); !ok && err != io.EOF {
+				log.Printf("speedtest server: %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// isTransfer reports whether line is a DOWNLOAD or UPLOAD command.
+func isTransfer(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) > 0 && (fields[0] == "DOWNLOAD" || fields[0] == "UPLOAD")
+}
+
+// refuse tells the client on conn that the server is busy. What the client
+// sends, such as the rest of an upload, is then drained until it hangs up,
+// since closing a connection with unread data resets it, which could discard
+// the reply before the client reads it.
+func refuse(conn net.Conn) {
+	io.WriteString(conn, serverBusy+"\n")
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(busyLinger))
+	io.Copy(ioutil.Discard, io.LimitReader(conn, maxBusyDrain))
+}
+
+// handle answers a single command, returning io.EOF once the client quits.
+func (s *Server) handle(conn net.Conn, r *bufio.Reader, line string, limits *clientLimiter) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty command")
+	}
+
+	switch fields[0] {
+	case "HI":
+		_, err := fmt.Fprintf(conn, "%s\n", serverGreeting)
+		return err
+
+	case "PING":
+		_, err := fmt.Fprintf(conn, "PONG %d\n", time.Now().UnixNano()/int64(time.Millisecond))
+		return err
+
+	case "DOWNLOAD":
+		size, err := requestSize(fields)
+		if err != nil {
+			return err
+		}
+		return serveDownload(conn, size, limits.down)
+
+	case "UPLOAD":
+		size, err := requestSize(fields)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		if err := serveUpload(conn, r, size-len(line), limits.up); err != nil {
+			return err
+		}
+		elapsed := time.Since(start) / time.Millisecond
+		_, err = fmt.Fprintf(conn, "OK %d %d\n", size, elapsed)
+		return err
+
+	case "QUIT":
+		return io.EOF
+
+	default:
+		return fmt.Errorf("unknown command %q", fields[0])
+	}
+}
+
+func requestSize(fields []string) (int, error) {
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("%s is missing a size", fields[0])
+	}
+	size, err := strconv.Atoi(fields[1])
+	if err != nil || size < 0 || size > maxRequestSize {
+		return 0, fmt.Errorf("invalid %s size %q", fields[0], fields[1])
+	}
+	return size, nil
+}
+
+// serveDownload writes size bytes of filler data ending in a newline to conn.
+func serveDownload(conn net.Conn, size int, l *limiter) error {
+	for remaining := size; remaining > 0; {
+		b := payload
+		if remaining < len(b) {
+			b = b[:remaining]
+		}
+		l.wait(len(b))
+		if remaining == len(b) {
+			// the last chunk has to end in a newline.
+			b = append(append([]byte(nil), b[:len(b)-1]...), '\n')
+		}
+		conn.SetDeadline(time.Now().Add(serverIdleTimeout))
+		n, err := conn.Write(b)
+		remaining -= n
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveUpload reads and discards size bytes sent over conn, which r buffers.
+func serveUpload(conn net.Conn, r io.Reader, size int, l *limiter) error {
+	buf := make([]byte, 32*1024)
+	for remaining := size; remaining > 0; {
+		if remaining < len(buf) {
+			buf = buf[:remaining]
+		}
+		conn.SetDeadline(time.Now().Add(serverIdleTimeout))
+		n, err := r.Read(buf)
+		remaining -= n
+		if err != nil {
+			return err
+		}
+		l.wait(n)
+	}
+	return nil
+}
+
+// acquire takes one of the MaxConns slots, if any are free.
+func (s *Server) acquire() bool {
+	slots := s.connSlots()
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) release() {
+	if slots := s.connSlots(); slots != nil {
+		<-slots
+	}
+}
+
+// connSlots is the semaphore of MaxConns slots, or nil if there is no limit.
+func (s *Server) connSlots() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.slots == nil && s.MaxConns > 0 {
+		s.slots = make(chan struct{}, s.MaxConns)
+	}
+	return s.slots
+}
+
+// limiter returns the limiters shared by every connection from host.
+func (s *Server) limiter(host string) *clientLimiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limiters == nil {
+		s.limiters = make(map[string]*clientLimiter)
+	}
+	l, ok := s.limiters[host]
+	if !ok {
+		l = &clientLimiter{down: newLimiter(s.RateLimit), up: newLimiter(s.RateLimit)}
+		s.limiters[host] = l
+	}
+	l.refs++
+	return l
+}
+
+func (s *Server) releaseLimiter(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.limiters[host]
+	if l.refs--; l.refs == 0 {
+		delete(s.limiters, host)
+	}
+}
@@ -0,0 +1,100 @@
+package speedtest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+// serveTest starts s on a loopback port until the test ends, and returns a
+// backend that tests against it.
+func serveTest(t *testing.T, s *Server) Backend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.Serve(ctx, l)
+	return NewSpeedtestNetBackend(&stdn.Testserver{Host: l.Addr().String()})
+}
+
+func testOptions(streams int) TransferOptions {
+	return TransferOptions{Duration: 300 * time.Millisecond, Streams: streams, SampleInterval: 50 * time.Millisecond}
+}
+
+func TestServerRoundTrip(t *testing.T) {
+	backend := serveTest(t, &Server{})
+	ctx := context.Background()
+
+	for name, transfer := range map[string]func(context.Context, TransferOptions) (*Transfer, error){
+		"download": backend.Download,
+		"upload":   backend.Upload,
+	} {
+		got, err := transfer(ctx, testOptions(2))
+		if err != nil {
+			t.Errorf("%s failed: %s", name, err)
+			continue
+		}
+		if len(got.Streams) != 2 || got.Streams[0].Bytes == 0 || got.Streams[1].Bytes == 0 {
+			t.Errorf("%s streams = %+v, want two that moved data", name, got.Streams)
+		}
+		if got.Speed <= 0 || len(got.Samples) == 0 {
+			t.Errorf("%s = %+v, want a speed and samples", name, got)
+		}
+	}
+
+	samples, lost, err := backend.Latency(ctx, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 3 || lost != 0 {
+		t.Errorf("Latency = %v with %d lost, want 3 samples", samples, lost)
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	const rate = 8 * 1024 * 1024
+	backend := serveTest(t, &Server{RateLimit: rate})
+
+	got, err := backend.Download(context.Background(), testOptions(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both streams share the client's limit, which lets a burst of one
+	// chunk through.
+	if got.Speed > 2*rate {
+		t.Errorf("Speed = %s, want at most about %s", got.Speed, Speed(rate))
+	}
+}
+
+func TestServerMaxConns(t *testing.T) {
+	backend := serveTest(t, &Server{MaxConns: 1})
+	if _, err := backend.Download(context.Background(), testOptions(2)); err != errServerBusy {
+		t.Errorf("Download with too many streams = %v, want %v", err, errServerBusy)
+	}
+	if _, err := backend.Upload(context.Background(), testOptions(2)); err != errServerBusy {
+		t.Errorf("Upload with too many streams = %v, want %v", err, errServerBusy)
+	}
+	if _, err := backend.Download(context.Background(), testOptions(1)); err != nil {
+		t.Errorf("Download within the limit failed: %s", err)
+	}
+}
+
+func TestServerMaxConnsLeavesRoomForProbes(t *testing.T) {
+	backend := serveTest(t, &Server{MaxConns: 2})
+	c := NewBackendClient(&Config{Streams: 2, LoadedLatency: true}, backend)
+
+	for i := 0; i < 3; i++ {
+		result := c.RunContext(context.Background(), 300*time.Millisecond, []Phase{PhaseDownload, PhaseUpload, PhasePing})
+		if result.Err != nil {
+			t.Fatalf("test %d failed: %s", i, result.Err)
+		}
+		if result.BufferbloatGrade == "" {
+			t.Errorf("test %d has no bufferbloat grade", i)
+		}
+	}
+}
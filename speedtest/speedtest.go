@@ -1,10 +1,14 @@
 package speedtest
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
@@ -15,14 +19,167 @@ import (
 // Speed is bandwidth speed in bits/sec
 type Speed uint64
 
+// ErrCanceled is the Result.Err of a speed test, or the error from
+// NewClientContext, when the context passed in is done before the work
+// finishes. Use the context's Err to tell a cancellation from a deadline.
+var ErrCanceled = errors.New("speedtest canceled")
+
+// ErrDeferred is the Result.Err of a speed test that didn't run because
+// there was more background traffic than Config.CrossTraffic allows.
+var ErrDeferred = errors.New("speedtest deferred due to background traffic")
+
 type Config struct {
 	ServerBlacklist []string `json:"serverBlacklist,omitempty"`
+
+	// Backend is the measurement protocol: "tcp" (the default) or "http" to
+	// test against speedtest.net servers, "iperf3" to test against an iperf3
+	// server, or "librespeed" to test against LibreSpeed servers.
+	Backend string `json:"backend,omitempty"`
+
+	// Server is the server to test against: its host:port for the tcp
+	// backend, such as one run with `speedtestdog serve`, the URL of its
+	// upload.php for the http backend, its host[:port] for the iperf3
+	// backend, or the base URL of its endpoints for the librespeed backend.
+	// If empty, the closest speedtest.net server is used, which isn't
+	// possible with the iperf3 backend.
+	Server string `json:"server,omitempty"`
+
+	// LibreSpeedServers are the base URLs of the LibreSpeed servers the
+	// librespeed backend picks the closest of, such as
+	// "https://speed.example.com/backend/", or one run with
+	// `speedtestdog serve -httpListen`.
+	LibreSpeedServers []string `json:"libreSpeedServers,omitempty"`
+
+	// AddressFamily forces tests over "v4" or "v6", or with "both", runs a
+	// separate test over each, for which see NewClientsContext. Empty means
+	// whichever the system picks.
+	AddressFamily string `json:"addressFamily,omitempty"`
+
+	// SourceAddress is the local IP address to make every connection from,
+	// to choose which uplink of a multi-homed host is tested. Empty means
+	// whichever the system picks.
+	SourceAddress string `json:"sourceAddress,omitempty"`
+
+	// Interface is the name of the network interface to bind every
+	// connection to, which is only supported on Linux. Empty means
+	// whichever the routing table picks.
+	Interface string `json:"interface,omitempty"`
+
+	// Proxy is the URL of a proxy to make TCP connections through, either
+	// socks5://host:port or http://host:port, optionally with
+	// user:password@ credentials. Plain HTTP requests are forwarded through
+	// an HTTP proxy, and everything else tunnelled with CONNECT. It is used
+	// for server discovery and the tests themselves; UDP, ICMP and
+	// traceroute probes can't be proxied and are sent directly. It can't be
+	// combined with an AddressFamily, since the proxy picks the family it
+	// connects to the server over.
+	Proxy string `json:"proxy,omitempty"`
+
+	// Streams is the number of concurrent connections used for each of the
+	// download and upload tests. Zero means a single stream.
+	Streams int `json:"streams,omitempty"`
+
+	// PingCount is the number of latency probes sent in each test. Zero means
+	// defaultPingCount.
+	PingCount int `json:"pingCount,omitempty"`
+
+	// LoadedLatency enables probing latency while the download and upload
+	// tests run, so that bufferbloat can be measured.
+	LoadedLatency bool `json:"loadedLatency,omitempty"`
+
+	// SampleInterval is how often throughput is sampled during the download
+	// and upload tests. Zero means defaultSampleInterval.
+	SampleInterval Duration `json:"sampleInterval,omitempty"`
+
+	// UDP, if set, enables a UDP probe after the other tests to measure
+	// packet loss, which TCP hides by retransmitting.
+	UDP *UDPConfig `json:"udp,omitempty"`
+
+	// DNS, if set, enables a DNS probe after the other tests to time name
+	// resolution.
+	DNS *DNSConfig `json:"dns,omitempty"`
+
+	// HTTPTargets are URLs fetched after the other tests, timing each phase
+	// of the request, to check that the services we depend on are reachable
+	// and responsive.
+	HTTPTargets []HTTPTarget `json:"httpTargets,omitempty"`
+
+	// Traceroute, if set, traces the path to the server whenever a test fails
+	// or its results are degraded.
+	Traceroute *TracerouteConfig `json:"traceroute,omitempty"`
+
+	// ICMP, if set, pings its hosts after the other tests.
+	ICMP *ICMPConfig `json:"icmp,omitempty"`
+
+	// PathMTU enables discovering the path MTU to the server after the other
+	// tests.
+	PathMTU bool `json:"pathMTU,omitempty"`
+
+	// Phases are the phases SpeedTest runs. Empty means AllPhases.
+	Phases []Phase `json:"phases,omitempty"`
+
+	// Schedules, if set, run different phases on independent intervals
+	// instead of Phases on a single one. They are followed by whatever
+	// schedules the tests.
+	Schedules []Schedule `json:"schedules,omitempty"`
+
+	// Profiles are named variations of the Config, which Schedules can pick
+	// between, for which see Config.Profile.
+	Profiles map[string]*Profile `json:"profiles,omitempty"`
+
+	// Budget, if set, caps the data tests use. It is enforced by whatever
+	// schedules the tests, with a Budget opened from it.
+	Budget *BudgetConfig `json:"budget,omitempty"`
+
+	// CrossTraffic, if set, watches the tested interface for other traffic
+	// before and during each test. Only supported on Linux.
+	CrossTraffic *CrossTrafficConfig `json:"crossTraffic,omitempty"`
+}
+
+// Duration is a time.Duration that is written in JSON as a string such as
+// "100ms".
+type Duration time.Duration
+
+// UnmarshalJSON parses d from a string accepted by time.ParseDuration.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes d as a string such as "100ms".
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
+const (
+	defaultPingCount      = 10
+	defaultSampleInterval = 100 * time.Millisecond
+
+	// loadedPingInterval is the gap between latency probes sent while a
+	// download or upload test is running.
+	loadedPingInterval = 100 * time.Millisecond
+)
+
 // Client is the object used to connect to a speedtest server and run speed tests.
 type Client struct {
-	server *stdn.Testserver
-	config *Config
+	backend Backend
+	config  *Config
+	dial    *dialer
+
+	// phases are those the current test was asked to run, ran those it has
+	// started, and errs why any of them failed. err is the first failure,
+	// which is ErrCanceled once the test is canceled.
+	phases map[Phase]bool
+	ran    []Phase
+	errs   map[Phase]error
 	err    error
 }
 
@@ -33,6 +190,77 @@ type Result struct {
 	UploadSpeed   Speed
 	Ping          time.Duration
 	Err           error
+
+	// Phases are the phases the test ran, and Errors holds why each one that
+	// failed did. A failed phase doesn't stop the others, so Err is the first
+	// of Errors.
+	Phases []Phase
+	Errors map[Phase]error
+
+	// Download and Upload break the throughput down per stream.
+	Download Transfer
+	Upload   Transfer
+
+	// Latency holds every ping sample and the statistics derived from them.
+	// Ping is its median.
+	Latency LatencyStats
+
+	// DownloadLatency and UploadLatency hold the latency measured while the
+	// download and upload tests were running. They are only populated when
+	// Config.LoadedLatency is set, and are left empty if the probe failed.
+	DownloadLatency LatencyStats
+	UploadLatency   LatencyStats
+
+	// Bufferbloat is how much the median latency rose under load, graded in
+	// BufferbloatGrade. It is only set if the latency was measured both idle
+	// and under each load.
+	Bufferbloat      time.Duration
+	BufferbloatGrade string
+
+	// UDP is the outcome of the UDP probe, if Config.UDP is set.
+	UDP *UDPResult
+
+	// DNS holds the outcome of the DNS probe for each resolver, if
+	// Config.DNS is set.
+	DNS []DNSResult
+
+	// HTTP holds the outcome of fetching each of Config.HTTPTargets.
+	HTTP []HTTPResult
+
+	// Traceroute is the path to the server, if Config.Traceroute is set and
+	// the test failed or was degraded.
+	Traceroute *Traceroute
+
+	// ICMP holds the outcome of pinging each of Config.ICMP's hosts.
+	ICMP []ICMPResult
+
+	// PathMTU is the path MTU to the server, if Config.PathMTU is set and it
+	// could be discovered.
+	PathMTU *PathMTU
+
+	// IPVersion is the IP version, 4 or 6, of the connections to the server
+	// the download, upload or ping made, or of the configured
+	// AddressFamily if none of them ran. It is zero if unknown, as it is
+	// through a proxy.
+	IPVersion int
+
+	// ProxyOverhead is how long the proxy took to open each tunnel the test
+	// used, on top of connecting to the proxy itself, if Config.Proxy is set.
+	// Pings over a tunnel include the proxy's hop, so this puts them in
+	// context.
+	ProxyOverhead *LatencyStats
+
+	// Bytes is the number of bytes sent and received over every connection
+	// since the previous test, including any used to select the server. It
+	// doesn't include ICMP or traceroute probes, whose cost is negligible.
+	Bytes uint64
+
+	// CrossTraffic is the other traffic on the tested interface, if
+	// Config.CrossTraffic is set and the interface's counters could be read.
+	CrossTraffic *CrossTraffic
+
+	// Tags are added to every metric reported for the result.
+	Tags []string
 }
 
 func ReadConfig(r io.Reader) (*Config, error) {
@@ -47,44 +275,141 @@ func ReadConfig(r io.Reader) (*Config, error) {
 	return &config, nil
 }
 
-func closestAvailableServer(cfg *stdn.Config, serverBlacklist []string) (*stdn.Testserver, error) {
-	blacklist := make(map[string]struct{})
+// NewClient creates a speedtest.Client, or an error if it could not find a server.
+func NewClient(config *Config) (*Client, error) {
+	return NewClientContext(context.Background(), config)
+}
 
-	for _, s := range serverBlacklist {
-		blacklist[s] = struct{}{}
+// NewClientContext is like NewClient, but gives up with ErrCanceled once ctx is
+// done.
+func NewClientContext(ctx context.Context, config *Config) (*Client, error) {
+	if config.AddressFamily == "both" {
+		return nil, errors.New(`use NewClientsContext to test with AddressFamily "both"`)
 	}
-
-	for _, s := range cfg.Servers {
-		if _, ok := blacklist[s.Host]; ok {
-			// server is blacklisted, skip.
-			continue
+	if err := validatePhases(config.Phases); err != nil {
+		return nil, err
+	}
+	if err := validateSchedules(config); err != nil {
+		return nil, err
+	}
+	for name, profile := range config.Profiles {
+		if err := validatePhases(profile.Phases); err != nil {
+			return nil, fmt.Errorf("profile %q: %s", name, err)
 		}
+	}
+	d, err := newDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Backend == "librespeed" {
+		return newLibreSpeedClient(ctx, config, d)
+	}
 
-		if _, err := s.MedianPing(1); err != nil {
-			log.Println("failed to connect to %s, trying another. Error: %s", s.Host, err)
-			continue
-		}
-		return &s, nil
+	newBackend, err := newBackendFactory(config.Backend, d)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("no available servers")
-}
+	if config.Server != "" {
+		server := &stdn.Testserver{
+			Host: config.Server,
+			Name: config.Server,
+			URLs: []string{config.Server},
+		}
+		backend, err := newBackend(server)
+		if err != nil {
+			return nil, err
+		}
+		return newClient(config, backend, d), nil
+	}
+	if config.Backend == "iperf3" {
+		return nil, errors.New("the iperf3 backend needs a server to test against")
+	}
 
-// NewClient creates a speedtest.Client, or an error if it could not find a server.
-func NewClient(config *Config) (*Client, error) {
 	log.Println("Fetching speedtest.net configuration...")
-	stdnConfig, err := stdn.GetConfig()
+	client := &http.Client{
+		Timeout: discoveryTimeout,
+		Transport: &http.Transport{
+			Proxy:       d.httpProxy,
+			DialContext: d.DialContext,
+		},
+	}
+	servers, err := fetchServers(ctx, client)
+	if ctx.Err() != nil {
+		return nil, ErrCanceled
+	}
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "Failed to fetch speedtest.net configuration")
 	}
 
 	log.Println("Finding the closest server...")
-	server, err := closestAvailableServer(stdnConfig, config.ServerBlacklist)
+	backend, err := closestAvailableServer(ctx, servers, config.ServerBlacklist, newBackend)
+	if ctx.Err() != nil {
+		return nil, ErrCanceled
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &Client{server: server}, nil
+	return newClient(config, backend, d), nil
+}
+
+// NewClientsContext creates a Client for each address family config asks
+// for: one each for IPv4 and IPv6 when its AddressFamily is "both", and
+// otherwise the one NewClientContext would create.
+func NewClientsContext(ctx context.Context, config *Config) ([]*Client, error) {
+	if config.AddressFamily != "both" {
+		client, err := NewClientContext(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		return []*Client{client}, nil
+	}
+
+	var clients []*Client
+	for _, family := range []string{"v4", "v6"} {
+		familyConfig := *config
+		familyConfig.AddressFamily = family
+		client, err := NewClientContext(ctx, &familyConfig)
+		if err == ErrCanceled {
+			return nil, err
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create %s client", family)
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+func newLibreSpeedClient(ctx context.Context, config *Config, d *dialer) (*Client, error) {
+	servers := config.LibreSpeedServers
+	if config.Server != "" {
+		servers = []string{config.Server}
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("the librespeed backend needs a server to test against")
+	}
+
+	log.Println("Finding the closest LibreSpeed server...")
+	backend, err := closestLibreSpeedServer(ctx, servers, d)
+	if ctx.Err() != nil {
+		return nil, ErrCanceled
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(config, backend, d), nil
+}
+
+// NewBackendClient creates a speedtest.Client that runs its tests with backend.
+func NewBackendClient(config *Config, backend Backend) *Client {
+	return newClient(config, backend, &dialer{})
+}
+
+func newClient(config *Config, backend Backend, d *dialer) *Client {
+	return &Client{backend: backend, config: config, dial: d}
 }
 
 func (s Speed) String() string {
@@ -93,56 +418,372 @@ func (s Speed) String() string {
 
 // SpeedTest runs a speedtest calculating download, upload and ping in sequence.
 func (c *Client) SpeedTest(duration time.Duration) *Result {
+	return c.SpeedTestContext(context.Background(), duration)
+}
+
+// SpeedTestContext is like SpeedTest, but stops early once ctx is done, in
+// which case the Result's Err is ErrCanceled. It runs the configured Phases.
+func (c *Client) SpeedTestContext(ctx context.Context, duration time.Duration) *Result {
+	return c.RunContext(ctx, duration, c.Phases())
+}
+
+// PingTestContext runs everything SpeedTestContext does except the download
+// and upload, for when data is too scarce for a full test.
+func (c *Client) PingTestContext(ctx context.Context) *Result {
+	return c.RunContext(ctx, 0, WithoutTransfers(c.Phases()))
+}
+
+// Phases are the phases SpeedTestContext runs.
+func (c *Client) Phases() []Phase {
+	if len(c.config.Phases) == 0 {
+		return AllPhases
+	}
+	return c.config.Phases
+}
+
+// RunContext runs only phases of a test, whose download and upload last for
+// duration each. Phases run in the order of AllPhases whatever their order in
+// phases.
+func (c *Client) RunContext(ctx context.Context, duration time.Duration, phases []Phase) *Result {
+	c.phases = make(map[Phase]bool)
+	for _, phase := range phases {
+		c.phases[phase] = true
+	}
+	c.ran = nil
+	c.errs = make(map[Phase]error)
 	c.err = nil
-	seconds := int(duration.Seconds())
-	d := c.download(seconds)
-	u := c.upload(seconds)
-	p := c.ping(seconds)
+	// tunnels opened before the test, such as for server selection, aren't
+	// part of it.
+	c.dial.takeTunnels()
+
+	var traffic *CrossTraffic
+	var counters interfaceCounters
+	if c.config.CrossTraffic != nil {
+		var err error
+		traffic, counters, err = c.watchCrossTraffic(ctx)
+		if ctx.Err() != nil {
+			return &Result{Err: ErrCanceled}
+		}
+		if err != nil {
+			log.Printf("Watching cross traffic to %s failed: %s", c.Host(), err)
+		} else if max := c.config.CrossTraffic.MaxBackground; max > 0 && traffic.Before > max {
+			return &Result{Err: ErrDeferred, CrossTraffic: traffic}
+		}
+	}
+	started, startBytes := time.Now(), c.dial.bytesSoFar()
 
-	return &Result{DownloadSpeed: d, UploadSpeed: u, Ping: p, Err: c.err}
+	// the IP version is that of the backend's own connections, in the first
+	// of the phases that make them to run, rather than of whatever the
+	// probes or the cross traffic watch connected to last.
+	c.dial.takeIPVersion()
+	version := 0
+	measured := func() {
+		if v := c.dial.takeIPVersion(); version == 0 {
+			version = v
+		}
+	}
+	d, dl := c.download(ctx, duration)
+	measured()
+	u, ul := c.upload(ctx, duration)
+	measured()
+	p := c.ping(ctx)
+	measured()
+	if version == 0 && c.dial.family != "" {
+		version, _ = strconv.Atoi(c.dial.family)
+	}
+	udp := c.udp(ctx)
+	dns := c.dns(ctx)
+	targets := c.httpTargets(ctx)
+	icmp := c.icmp(ctx)
+	mtu := c.pathMTU(ctx)
+	if traffic != nil {
+		err := crossTrafficDuring(traffic, counters, time.Since(started), c.dial.bytesSoFar()-startBytes)
+		if err != nil {
+			log.Printf("Watching cross traffic to %s failed: %s", c.Host(), err)
+			traffic = nil
+		}
+	}
+
+	result := &Result{
+		DownloadSpeed:   d.Speed,
+		UploadSpeed:     u.Speed,
+		Ping:            p.Median,
+		Err:             c.err,
+		Phases:          c.ran,
+		Errors:          c.errs,
+		Download:        d,
+		Upload:          u,
+		Latency:         p,
+		DownloadLatency: dl,
+		UploadLatency:   ul,
+		UDP:             udp,
+		DNS:             dns,
+		HTTP:            targets,
+		ICMP:            icmp,
+		PathMTU:         mtu,
+		IPVersion:       version,
+		Bytes:           c.dial.takeBytes(),
+		CrossTraffic:    traffic,
+	}
+	if c.dial.proxy != nil {
+		overhead := newLatencyStats(c.dial.takeTunnels(), 0)
+		result.ProxyOverhead = &overhead
+	}
+	if result.IPVersion != 0 {
+		result.Tags = append(result.Tags, fmt.Sprintf("speedtest.ip_version:%d", result.IPVersion))
+	}
+	if c.config.Interface != "" {
+		result.Tags = append(result.Tags, "speedtest.interface:"+c.config.Interface)
+	}
+	if mtu != nil {
+		result.Tags = append(result.Tags, mtu.Tag())
+	}
+	if len(dl.Samples) > 0 && len(ul.Samples) > 0 && len(p.Samples) > 0 {
+		loaded := dl.Median
+		if ul.Median > loaded {
+			loaded = ul.Median
+		}
+		result.Bufferbloat = loaded - p.Median
+		result.BufferbloatGrade = gradeBufferbloat(result.Bufferbloat)
+	}
+	c.traceroute(ctx, result)
+
+	return result
 }
 
 // Host returns the address of the speedtest server.
 func (c *Client) Host() string {
-	return c.server.Host
+	return c.backend.Server().Host
 }
 
 // Location returns the location of the speedtest server.
 func (c *Client) Location() string {
-	return c.server.Name
+	return c.backend.Server().Location
+}
+
+func (c *Client) download(ctx context.Context, duration time.Duration) (Transfer, LatencyStats) {
+	if !c.begin(PhaseDownload, duration > 0) {
+		return Transfer{}, LatencyStats{}
+	}
+	col := newTCPInfoCollector()
+	t, l, err := c.underLoad(ctx, func() (*Transfer, error) {
+		return c.backend.Download(withTCPInfo(ctx, col), c.transferOptions(duration))
+	})
+	if err != nil {
+		c.fail(ctx, PhaseDownload, "Error getting download: %s", err)
+		return Transfer{}, LatencyStats{}
+	}
+	t.TCPInfo = col.finish()
+	return *t, l
+}
+
+func (c *Client) upload(ctx context.Context, duration time.Duration) (Transfer, LatencyStats) {
+	if !c.begin(PhaseUpload, duration > 0) {
+		return Transfer{}, LatencyStats{}
+	}
+	col := newTCPInfoCollector()
+	t, l, err := c.underLoad(ctx, func() (*Transfer, error) {
+		return c.backend.Upload(withTCPInfo(ctx, col), c.transferOptions(duration))
+	})
+	if err != nil {
+		c.fail(ctx, PhaseUpload, "Error getting upload: %s", err)
+		return Transfer{}, LatencyStats{}
+	}
+	t.TCPInfo = col.finish()
+	return *t, l
 }
 
-func (c *Client) download(duration int) Speed {
-	if c.err != nil {
-		return 0
+// begin reports whether phase runs in the current test, and notes that it
+// has if so. configured is whether the Config has what the phase needs.
+func (c *Client) begin(phase Phase, configured bool) bool {
+	if !configured || !c.phases[phase] || c.err == ErrCanceled {
+		return false
+	}
+	c.ran = append(c.ran, phase)
+	return true
+}
+
+// fail records err as the reason phase failed, unless it was caused by ctx
+// being done, which cancels the rest of the test.
+func (c *Client) fail(ctx context.Context, phase Phase, format string, err error) {
+	if ctx.Err() != nil {
+		c.err = ErrCanceled
+		return
+	}
+	c.errs[phase] = fmt.Errorf(format, err)
+	if c.err == nil {
+		c.err = c.errs[phase]
+	}
+}
+
+func (c *Client) transferOptions(duration time.Duration) TransferOptions {
+	interval := time.Duration(c.config.SampleInterval)
+	if interval <= 0 {
+		interval = defaultSampleInterval
+	}
+	return TransferOptions{
+		Duration:       duration,
+		Streams:        c.config.Streams,
+		SampleInterval: interval,
+	}
+}
+
+// underLoad runs transfer, probing latency alongside it if the client is
+// configured to measure loaded latency. The probe failing only costs the
+// loaded latency, which is then empty, rather than the transfer.
+func (c *Client) underLoad(ctx context.Context, transfer func() (*Transfer, error)) (*Transfer, LatencyStats, error) {
+	if !c.config.LoadedLatency {
+		t, err := transfer()
+		return t, LatencyStats{}, err
+	}
+
+	var samples []time.Duration
+	var lost int
+	var pingErr error
+	probeCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		samples, lost, pingErr = c.backend.Latency(probeCtx, 0, loadedPingInterval)
+	}()
+
+	t, err := transfer()
+	stop()
+	<-done
+
+	if err == nil && pingErr != nil {
+		log.Printf("Loaded latency to %s failed: %s", c.Host(), pingErr)
+		return t, LatencyStats{}, nil
+	}
+	return t, newLatencyStats(samples, lost), err
+}
+
+func (c *Client) ping(ctx context.Context) LatencyStats {
+	if !c.begin(PhasePing, true) {
+		return LatencyStats{}
+	}
+	count := c.config.PingCount
+	if count <= 0 {
+		count = defaultPingCount
+	}
+	samples, lost, err := c.backend.Latency(ctx, count, 0)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == nil && len(samples) == 0 {
+		err = fmt.Errorf("all %d probes timed out", lost)
 	}
-	s, err := c.server.Downstream(duration)
 	if err != nil {
-		c.err = fmt.Errorf("Error getting download: %s", err)
+		c.fail(ctx, PhasePing, "Error getting ping: %s", err)
 	}
-	return Speed(s)
+	return newLatencyStats(samples, lost)
 }
 
-func (c *Client) upload(duration int) Speed {
-	if c.err != nil {
-		return 0
+func (c *Client) udp(ctx context.Context) *UDPResult {
+	if !c.begin(PhaseUDP, c.config.UDP != nil) {
+		return nil
 	}
-	s, err := c.server.Upstream(duration)
+	result, err := probeUDP(ctx, c.config.UDP, c.dial)
 	if err != nil {
-		c.err = fmt.Errorf("Error getting upload: %s", err)
+		c.fail(ctx, PhaseUDP, "Error getting UDP probe: %s", err)
+		return nil
+	}
+	return result
+}
+
+// dns runs the DNS probe. Failed lookups are part of its results, so only
+// cancellation fails the test.
+func (c *Client) dns(ctx context.Context) []DNSResult {
+	if !c.begin(PhaseDNS, c.config.DNS != nil) {
+		return nil
+	}
+	results := probeDNS(ctx, c.config.DNS, c.dial)
+	if ctx.Err() != nil {
+		c.fail(ctx, PhaseDNS, "Error getting DNS probe: %s", ctx.Err())
+		return nil
+	}
+	return results
+}
+
+// httpTargets fetches the configured HTTP targets. As with the DNS probe, a
+// target being unreachable is part of its result rather than a failed test.
+func (c *Client) httpTargets(ctx context.Context) []HTTPResult {
+	if !c.begin(PhaseHTTP, len(c.config.HTTPTargets) > 0) {
+		return nil
+	}
+	results := probeHTTP(ctx, c.config.HTTPTargets, c.dial)
+	if ctx.Err() != nil {
+		c.fail(ctx, PhaseHTTP, "Error getting HTTP targets: %s", ctx.Err())
+		return nil
 	}
-	return Speed(s)
+	return results
 }
 
-func (c *Client) ping(duration int) time.Duration {
-	if c.err != nil {
-		return 0
+// icmp pings the configured hosts. Hosts that can't be pinged are part of its
+// results rather than a failed test.
+func (c *Client) icmp(ctx context.Context) []ICMPResult {
+	if !c.begin(PhaseICMP, c.config.ICMP != nil) {
+		return nil
+	}
+	results := probeICMP(ctx, c.config.ICMP, c.dial)
+	if ctx.Err() != nil {
+		c.fail(ctx, PhaseICMP, "Error getting ICMP probe: %s", ctx.Err())
+		return nil
+	}
+	return results
+}
+
+// pathMTU discovers the path MTU to the server. Not every server answers the
+// probes, so failing to discover it doesn't fail the test.
+func (c *Client) pathMTU(ctx context.Context) *PathMTU {
+	if !c.begin(PhasePathMTU, c.config.PathMTU) {
+		return nil
+	}
+	mtu, err := discoverPathMTU(ctx, c.dial, c.Host())
+	if ctx.Err() != nil {
+		c.fail(ctx, PhasePathMTU, "Error getting path MTU: %s", ctx.Err())
+		return nil
 	}
-	t, err := c.server.MedianPing(3)
 	if err != nil {
-		c.err = fmt.Errorf("Error getting ping: %s", err)
+		log.Printf("Path MTU discovery to %s failed: %s", c.Host(), err)
+		return nil
 	}
-	return t
+	return mtu
+}
+
+// traceroute attaches the path to the server to result if it failed or was
+// degraded.
+func (c *Client) traceroute(ctx context.Context, result *Result) {
+	config := c.config.Traceroute
+	if config == nil || result.Err == ErrCanceled {
+		return
+	}
+	reason := degradedReason(result, config)
+	if reason == "" {
+		return
+	}
+
+	hops, err := runTraceroute(ctx, c.dial, c.Host(), config)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Traceroute to %s failed: %s", c.Host(), err)
+		}
+		return
+	}
+	result.Traceroute = &Traceroute{Target: c.Host(), Reason: reason, Hops: hops}
+}
+
+// Ran reports whether the test ran phase and it succeeded.
+func (result *Result) Ran(phase Phase) bool {
+	if result.Errors[phase] != nil {
+		return false
+	}
+	for _, p := range result.Phases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
 }
 
 func (result *Result) String() string {
@@ -150,36 +791,311 @@ func (result *Result) String() string {
 		return fmt.Sprintf("Failed Speedtest: %s", result.Err)
 	}
 
-	return fmt.Sprintf(
-		"Download:\t%s\tUpload:\t%s\tPing:\t%s",
-		result.DownloadSpeed,
-		result.UploadSpeed,
-		result.Ping,
-	)
+	var s string
+	if result.Ran(PhaseDownload) {
+		s += fmt.Sprintf("\tDownload:\t%s", result.DownloadSpeed)
+	}
+	if result.Ran(PhaseUpload) {
+		s += fmt.Sprintf("\tUpload:\t%s", result.UploadSpeed)
+	}
+	if result.Ran(PhasePing) {
+		s += fmt.Sprintf("\tPing:\t%s", result.Ping)
+	}
+	if TransfersIn(result.Phases) {
+		s += fmt.Sprintf("\tStreams:\t%d", len(result.Download.Streams))
+	}
+	if result.IPVersion != 0 {
+		s += fmt.Sprintf("\tIP:\tv%d", result.IPVersion)
+	}
+	if result.ProxyOverhead != nil {
+		s += fmt.Sprintf("\tProxy Overhead:\t%s", result.ProxyOverhead.Median)
+	}
+	s += fmt.Sprintf("\tData:\t%.1f MB", float64(result.Bytes)/1e6)
+	if len(result.Download.TCPInfo) > 0 || len(result.Upload.TCPInfo) > 0 {
+		s += fmt.Sprintf(
+			"\tRetransmits:\t%d / %d",
+			retransmits(result.Download.TCPInfo),
+			retransmits(result.Upload.TCPInfo),
+		)
+	}
+	if traffic := result.CrossTraffic; traffic != nil {
+		s += fmt.Sprintf("\tCross Traffic (%s):\t%s / %s", traffic.Interface, traffic.Before, traffic.During)
+	}
+	if result.BufferbloatGrade != "" {
+		s += fmt.Sprintf(
+			"\tLoaded Ping:\t%s / %s\tBufferbloat:\t%s",
+			result.DownloadLatency.Median,
+			result.UploadLatency.Median,
+			result.BufferbloatGrade,
+		)
+	}
+	if result.UDP != nil {
+		s += fmt.Sprintf(
+			"\tUDP Loss:\t%.1f%%\tUDP Jitter:\t%s",
+			result.UDP.Loss,
+			result.UDP.Latency.Jitter,
+		)
+	}
+	for _, dns := range result.DNS {
+		s += fmt.Sprintf(
+			"\tDNS (%s):\t%s\tDNS Failures:\t%d/%d",
+			dns.Resolver,
+			dns.Latency.Median,
+			dns.Failures,
+			dns.Queries,
+		)
+	}
+	for _, target := range result.HTTP {
+		if target.Err != nil {
+			s += fmt.Sprintf("\tHTTP (%s):\t%s", target.Target, target.Err)
+			continue
+		}
+		s += fmt.Sprintf("\tHTTP (%s):\t%s", target.Target, target.Total)
+	}
+	for _, icmp := range result.ICMP {
+		if icmp.Err != nil {
+			s += fmt.Sprintf("\tICMP (%s):\t%s", icmp.Host, icmp.Err)
+			continue
+		}
+		s += fmt.Sprintf("\tICMP (%s):\t%s\tICMP Lost:\t%d", icmp.Host, icmp.Latency.Median, icmp.Latency.Lost)
+	}
+	if result.PathMTU != nil {
+		s += fmt.Sprintf("\tPath MTU:\t%d", result.PathMTU.MTU)
+		if result.PathMTU.BlackHole {
+			s += " (black hole)"
+		}
+	}
+	return strings.TrimPrefix(s, "\t")
 }
 
 // Reporter will report your speedtest to a DataDog statsd.Client.
 type Reporter struct {
 	Client *statsd.Client
 
-	err error
+	// Tags are added to every metric the Reporter sends, such as the server
+	// of the Client whose results it reports.
+	Tags []string
+
+	// TCPInfo, if set, also reports the TCPInfo of every download and upload
+	// connection, tagged with its direction.
+	TCPInfo bool
+
+	err  error
+	tags []string
 }
 
 // Report sends the results from result to r.Client
 func (r *Reporter) Report(result *Result) error {
 	r.err = nil
+	r.tags = append(append([]string(nil), r.Tags...), result.Tags...)
+
+	if result.Ran(PhaseDownload) {
+		r.histogram("download", float64(result.DownloadSpeed))
+		r.histogram("download.steady", float64(result.Download.SteadySpeed))
+	}
+	if result.Ran(PhaseUpload) {
+		r.histogram("upload", float64(result.UploadSpeed))
+		r.histogram("upload.steady", float64(result.Upload.SteadySpeed))
+	}
+	if result.Ran(PhasePing) {
+		r.latency("ping", result.Latency)
+	}
+	r.count("bytes", int64(result.Bytes))
+	if r.TCPInfo {
+		r.tcpInfo(result.Download.TCPInfo, "speedtest.direction:download")
+		r.tcpInfo(result.Upload.TCPInfo, "speedtest.direction:upload")
+	}
+	r.count("deferred", 0)
+	if traffic := result.CrossTraffic; traffic != nil {
+		r.histogram("cross_traffic.before", float64(traffic.Before))
+		r.histogram("cross_traffic.during", float64(traffic.During))
+	}
+
+	if result.BufferbloatGrade != "" {
+		r.latency("ping.download", result.DownloadLatency)
+		r.latency("ping.upload", result.UploadLatency)
+		r.histogram("bufferbloat", float64(result.Bufferbloat),
+			"speedtest.bufferbloat_grade:"+result.BufferbloatGrade)
+	}
+
+	if result.ProxyOverhead != nil {
+		r.latency("proxy.overhead", *result.ProxyOverhead)
+	}
+
+	if udp := result.UDP; udp != nil {
+		r.latency("udp", udp.Latency)
+		r.histogram("udp.loss", udp.Loss)
+		r.count("udp.sent", int64(udp.Sent))
+		r.count("udp.lost.upstream", int64(udp.UpstreamLost))
+		r.count("udp.lost.downstream", int64(udp.DownstreamLost))
+		r.count("udp.reordered", int64(udp.Reordered))
+		r.count("udp.duplicates", int64(udp.Duplicates))
+	}
+
+	for _, dns := range result.DNS {
+		tag := "speedtest.dns_resolver:" + dns.Resolver
+		r.latency("dns", dns.Latency, tag)
+		r.count("dns.queries", int64(dns.Queries), tag)
+		r.count("dns.failures", int64(dns.Failures), tag)
+		r.count("dns.nxdomain", int64(dns.NXDomain), tag)
+		r.count("dns.servfail", int64(dns.ServFail), tag)
+	}
+
+	for _, target := range result.HTTP {
+		tag := "speedtest.http_target:" + target.Target
+		if target.Err != nil {
+			r.count("http.errors", 1, tag)
+			continue
+		}
+		r.count("http.errors", 0, tag)
+		r.histogram("http.dns", float64(target.DNS), tag)
+		r.histogram("http.connect", float64(target.Connect), tag)
+		r.histogram("http.tls", float64(target.TLS), tag)
+		r.histogram("http.ttfb", float64(target.TTFB), tag)
+		r.histogram("http.total", float64(target.Total), tag)
+	}
+
+	for _, icmp := range result.ICMP {
+		tag := "speedtest.icmp_host:" + icmp.Host
+		if icmp.Err != nil {
+			r.count("icmp.errors", 1, tag)
+			continue
+		}
+		r.count("icmp.errors", 0, tag)
+		r.latency("icmp", icmp.Latency, tag)
+	}
+
+	if mtu := result.PathMTU; mtu != nil {
+		r.histogram("path_mtu", float64(mtu.MTU))
+		blackHole := int64(0)
+		if mtu.BlackHole {
+			blackHole = 1
+		}
+		r.count("path_mtu.black_hole", blackHole)
+	}
+
+	if result.Traceroute != nil {
+		r.ReportTraceroute(result)
+	}
+
+	return r.err
+}
+
+// ReportTraceroute sends result's traceroute to r.Client as an event, as an
+// error if the test failed and a warning if it was only degraded. Report does
+// this itself for every result with a traceroute, failed or not.
+func (r *Reporter) ReportTraceroute(result *Result) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	event := statsd.NewEvent("Speedtest traceroute to "+result.Traceroute.Target, result.Traceroute.String())
+	event.Tags = append(append([]string(nil), r.Tags...), result.Tags...)
+	event.AlertType = statsd.Warning
+	if result.Err != nil {
+		event.AlertType = statsd.Error
+	}
+	r.err = r.Client.Event(event)
+	return r.err
+}
+
+// ReportDeferred records that result's test was deferred because of
+// background traffic, which Report doesn't, as the test has no results.
+func (r *Reporter) ReportDeferred(result *Result) error {
+	r.err = nil
+	r.tags = append(append([]string(nil), r.Tags...), result.Tags...)
+
+	r.count("deferred", 1)
+	if traffic := result.CrossTraffic; traffic != nil {
+		r.histogram("cross_traffic.before", float64(traffic.Before))
+	}
+	return r.err
+}
 
-	r.histogram("download", float64(result.DownloadSpeed))
-	r.histogram("upload", float64(result.UploadSpeed))
-	r.histogram("ping", float64(result.Ping))
+// ReportBudget sends the usage of b at now to r.Client, along with whether
+// mode, the Mode a test was given, skipped it.
+func (r *Reporter) ReportBudget(b *Budget, now time.Time, mode BudgetMode) error {
+	r.err = nil
+	r.tags = r.Tags
+	tag := "speedtest.budget_mode:" + string(mode)
 
+	day, month := b.Usage(now)
+	config := b.Config()
+	r.gauge("budget.daily.used", float64(day), tag)
+	r.gauge("budget.monthly.used", float64(month), tag)
+	if config.Daily > 0 {
+		r.gauge("budget.daily.fraction", float64(day)/float64(config.Daily), tag)
+	}
+	if config.Monthly > 0 {
+		r.gauge("budget.monthly.fraction", float64(month)/float64(config.Monthly), tag)
+	}
+	skipped := int64(0)
+	if mode == BudgetSkip {
+		skipped = 1
+	}
+	r.count("budget.skipped", skipped, tag)
 	return r.err
 }
 
-func (r *Reporter) histogram(name string, value float64) {
+// tcpInfo reports the TCPInfo of each of a transfer's connections. The
+// limited times are reported as fractions of the time the connection was busy.
+func (r *Reporter) tcpInfo(infos []TCPInfo, tags ...string) {
+	for _, info := range infos {
+		r.count("tcp.retransmits", int64(info.Retransmits), tags...)
+		r.histogram("tcp.rtt", float64(info.RTT), tags...)
+		r.histogram("tcp.rtt.var", float64(info.RTTVar), tags...)
+		r.histogram("tcp.rtt.min", float64(info.MinRTT), tags...)
+		r.histogram("tcp.cwnd", float64(info.Cwnd), tags...)
+		r.histogram("tcp.receive_window", float64(info.ReceiveWindow), tags...)
+		r.histogram("tcp.delivery_rate", float64(info.DeliveryRate), tags...)
+		if info.BusyTime > 0 {
+			r.histogram("tcp.rwnd_limited", float64(info.RwndLimited)/float64(info.BusyTime), tags...)
+			r.histogram("tcp.sndbuf_limited", float64(info.SndbufLimited)/float64(info.BusyTime), tags...)
+		}
+	}
+}
+
+// latency reports the median of stats as name, and the rest of its
+// statistics under name.
+func (r *Reporter) latency(name string, stats LatencyStats, tags ...string) {
+	r.histogram(name, float64(stats.Median), tags...)
+	r.histogram(name+".min", float64(stats.Min), tags...)
+	r.histogram(name+".max", float64(stats.Max), tags...)
+	r.histogram(name+".mean", float64(stats.Mean), tags...)
+	r.histogram(name+".p95", float64(stats.P95), tags...)
+	r.histogram(name+".jitter", float64(stats.Jitter), tags...)
+	r.count(name+".lost", int64(stats.Lost), tags...)
+}
+
+func (r *Reporter) histogram(name string, value float64, tags ...string) {
 	if r.err != nil {
 		return
 	}
 
-	r.err = r.Client.Histogram(name, value, nil, 1)
+	r.err = r.Client.Histogram(name, value, r.withTags(tags), 1)
+}
+
+func (r *Reporter) gauge(name string, value float64, tags ...string) {
+	if r.err != nil {
+		return
+	}
+
+	r.err = r.Client.Gauge(name, value, r.withTags(tags), 1)
+}
+
+func (r *Reporter) count(name string, value int64, tags ...string) {
+	if r.err != nil {
+		return
+	}
+
+	r.err = r.Client.Count(name, value, r.withTags(tags), 1)
+}
+
+// withTags adds the Reporter's tags and those of the result being reported
+// to tags.
+func (r *Reporter) withTags(tags []string) []string {
+	if len(r.tags) == 0 {
+		return tags
+	}
+	return append(append([]string(nil), tags...), r.tags...)
 }
@@ -0,0 +1,307 @@
+package speedtest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+const (
+	dialTimeout     = 10 * time.Second
+	transferTimeout = 10 * time.Second
+	pingTimeout     = 2 * time.Second
+
+	// Each stream repeatedly requests chunks of data until its deadline,
+	// doubling the chunk size while chunks complete faster than chunkTarget
+	// to keep the per-request overhead small on fast links.
+	startChunkSize = 64 * 1024
+	maxChunkSize   = 8 * 1024 * 1024
+	chunkTarget    = 250 * time.Millisecond
+)
+
+// errServerBusy is returned when a server refuses a transfer because it is
+// already serving as many as it allows.
+var errServerBusy = errors.New("server busy")
+
+// payload is the filler data sent to the server on upload.
+var payload = []byte(strings.Repeat("ABCDEFGHIJ", 3277))
+
+// speedtestNetBackend runs tests against a speedtest.net server over its TCP
+// protocol.
+type speedtestNetBackend struct {
+	server *stdn.Testserver
+	dial   *dialer
+}
+
+// NewSpeedtestNetBackend creates a Backend that tests against server using the
+// speedtest.net TCP protocol.
+func NewSpeedtestNetBackend(server *stdn.Testserver) Backend {
+	return &speedtestNetBackend{server: server, dial: &dialer{}}
+}
+
+func (b *speedtestNetBackend) Download(ctx context.Context, opts TransferOptions) (*Transfer, error) {
+	return runStreams(ctx, opts, func(ctx context.Context, deadline time.Time, n *uint64) error {
+		return b.stream(ctx, deadline, n, (*stdnConn).download)
+	})
+}
+
+func (b *speedtestNetBackend) Upload(ctx context.Context, opts TransferOptions) (*Transfer, error) {
+	return runStreams(ctx, opts, func(ctx context.Context, deadline time.Time, n *uint64) error {
+		return b.stream(ctx, deadline, n, (*stdnConn).upload)
+	})
+}
+
+func (b *speedtestNetBackend) Latency(ctx context.Context, count int, interval time.Duration) ([]time.Duration, int, error) {
+	var samples []time.Duration
+	var lost int
+	var conn *stdnConn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for i := 0; count == 0 || i < count; i++ {
+		delay := interval
+		if i == 0 {
+			delay = 0
+		}
+		if !wait(delay, ctx.Done()) {
+			break
+		}
+
+		if conn == nil {
+			var err error
+			if conn, err = dialStdn(ctx, b.dial, b.server.Host); err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				return nil, 0, err
+			}
+		}
+
+		rtt, err := conn.ping()
+		if ctx.Err() != nil {
+			break
+		}
+		if isTimeout(err) {
+			// the reply may still arrive, so start again on a fresh
+			// connection rather than read it as the next probe's reply.
+			conn.Close()
+			conn = nil
+			lost++
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		samples = append(samples, rtt)
+	}
+
+	return samples, lost, nil
+}
+
+func (b *speedtestNetBackend) Server() ServerInfo {
+	return ServerInfo{Host: b.server.Host, Location: b.server.Name}
+}
+
+// stream opens a connection to the server and moves chunks of data over it with
+// move until deadline passes, or until ctx is done. A chunk still in flight at
+// the deadline is cut short, and the bytes it moved so far are kept.
+func (b *speedtestNetBackend) stream(ctx context.Context, deadline time.Time, n *uint64, move func(*stdnConn, int, *uint64) error) error {
+	conn, err := dialStdn(ctx, b.dial, b.server.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.deadline = deadline
+
+	size := startChunkSize
+	for {
+		start := time.Now()
+		err := move(conn, size, n)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isTimeout(err) && !time.Now().Before(deadline) {
+			// the connection is left mid-chunk, so there is no point
+			// saying goodbye.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return conn.quit()
+		}
+		if time.Since(start) < chunkTarget && size < maxChunkSize {
+			size *= 2
+		}
+	}
+}
+
+// stdnConn is a connection to a speedtest.net server.
+type stdnConn struct {
+	net.Conn
+	r    *bufio.Reader
+	stop func()
+
+	// deadline, if set, caps the I/O deadline of every command.
+	deadline time.Time
+}
+
+// dialStdn connects to a speedtest.net server and greets it. The connection is
+// closed early if ctx is done before it is.
+func dialStdn(ctx context.Context, d *dialer, host string) (*stdnConn, error) {
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &stdnConn{Conn: conn, r: bufio.NewReader(conn), stop: closeOnDone(ctx, conn)}
+	if err := c.hello(); err != nil {
+		c.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// hello exchanges greetings with the server.
+func (c *stdnConn) hello() error {
+	if _, err := c.command("HI"); err != nil {
+		return err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "HELLO ") {
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// Close closes the connection and stops watching its context.
+func (c *stdnConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// command sends a single protocol line to the server.
+func (c *stdnConn) command(format string, args ...interface{}) (string, error) {
+	cmd := fmt.Sprintf(format, args...) + "\n"
+	deadline := time.Now().Add(transferTimeout)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	if err := c.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+	_, err := io.WriteString(c, cmd)
+	return cmd, err
+}
+
+// download asks the server for size bytes and reads them back.
+func (c *stdnConn) download(size int, n *uint64) error {
+	if _, err := c.command("DOWNLOAD %d", size); err != nil {
+		return err
+	}
+	if size > len(serverBusy) {
+		if b, _ := c.r.Peek(len(serverBusy) + 1); string(b) == serverBusy+"\n" {
+			return errServerBusy
+		}
+	}
+
+	buf := make([]byte, 32*1024)
+	for remaining := size; remaining > 0; {
+		if remaining < len(buf) {
+			buf = buf[:remaining]
+		}
+		read, err := c.r.Read(buf)
+		atomic.AddUint64(n, uint64(read))
+		remaining -= read
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upload sends size bytes, including the command itself, to the server and
+// waits for it to acknowledge them.
+func (c *stdnConn) upload(size int, n *uint64) error {
+	cmd, err := c.command("UPLOAD %d 0", size)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(n, uint64(len(cmd)))
+
+	for remaining := size - len(cmd); remaining > 0; {
+		b := payload
+		if remaining < len(b) {
+			b = b[:remaining]
+		}
+		written, err := c.Write(b)
+		atomic.AddUint64(n, uint64(written))
+		remaining -= written
+		if err != nil {
+			return err
+		}
+	}
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(line) == serverBusy {
+		return errServerBusy
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("unexpected upload response %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// ping times a single PING/PONG exchange with the server.
+func (c *stdnConn) ping() (time.Duration, error) {
+	start := time.Now()
+	if _, err := c.command("PING %d", start.UnixNano()/int64(time.Millisecond)); err != nil {
+		return 0, err
+	}
+	if err := c.SetReadDeadline(start.Add(pingTimeout)); err != nil {
+		return 0, err
+	}
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	if !strings.HasPrefix(line, "PONG ") {
+		return 0, fmt.Errorf("unexpected ping response %q", strings.TrimSpace(line))
+	}
+	return rtt, nil
+}
+
+func (c *stdnConn) quit() error {
+	c.deadline = time.Time{}
+	_, err := c.command("QUIT")
+	return err
+}
+
+// isTimeout reports whether err is a network timeout.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
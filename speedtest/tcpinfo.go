@@ -0,0 +1,128 @@
+package speedtest
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TCPInfo is the kernel's view of a measurement connection at the end of a
+// download or upload, which tells apart the reasons it was slow. Only
+// supported on Linux, other than on 386, whose socket calls are multiplexed.
+//
+// The congestion window, delivery rate and limited times describe the
+// connection's sending side, so they are only telling for uploads.
+type TCPInfo struct {
+	// Retransmits is the number of segments retransmitted over the life of
+	// the connection.
+	Retransmits uint32
+
+	// RTT and RTTVar are the smoothed round trip time and its variation, and
+	// MinRTT is the lowest round trip time seen.
+	RTT    time.Duration
+	RTTVar time.Duration
+	MinRTT time.Duration
+
+	// Cwnd is the congestion window, in segments of MSS bytes.
+	Cwnd uint32
+	MSS  uint32
+
+	// ReceiveWindow is the window the peer last advertised, in bytes.
+	ReceiveWindow uint32
+
+	// DeliveryRate is the most recent estimate of the rate data is being
+	// delivered to the peer.
+	DeliveryRate Speed
+
+	// BusyTime is how long the connection had data to send, and RwndLimited
+	// and SndbufLimited are how much of that it spent held back by the
+	// peer's receive window and by the local send buffer.
+	BusyTime      time.Duration
+	RwndLimited   time.Duration
+	SndbufLimited time.Duration
+}
+
+// retransmits is the total retransmits over infos.
+func retransmits(infos []TCPInfo) uint32 {
+	var total uint32
+	for _, info := range infos {
+		total += info.Retransmits
+	}
+	return total
+}
+
+type tcpInfoKey struct{}
+
+// withTCPInfo returns a context under which the dialer's TCP connections are
+// added to col.
+func withTCPInfo(ctx context.Context, col *tcpInfoCollector) context.Context {
+	return context.WithValue(ctx, tcpInfoKey{}, col)
+}
+
+// withoutTCPInfo returns a context under which TCP connections aren't added
+// to any collector, for those that don't carry test data.
+func withoutTCPInfo(ctx context.Context) context.Context {
+	return withTCPInfo(ctx, nil)
+}
+
+func tcpInfoFrom(ctx context.Context) *tcpInfoCollector {
+	col, _ := ctx.Value(tcpInfoKey{}).(*tcpInfoCollector)
+	return col
+}
+
+// tcpInfoCollector gathers the TCPInfo of a transfer's connections, reading
+// each as it is closed, or when the transfer finishes if it is still open.
+type tcpInfoCollector struct {
+	mu       sync.Mutex
+	conns    map[*countingConn]struct{}
+	infos    []TCPInfo
+	finished bool
+}
+
+func newTCPInfoCollector() *tcpInfoCollector {
+	return &tcpInfoCollector{conns: make(map[*countingConn]struct{})}
+}
+
+func (col *tcpInfoCollector) add(c *countingConn) {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	if !col.finished {
+		col.conns[c] = struct{}{}
+	}
+}
+
+// closing reads the TCPInfo of c, which is about to be closed.
+func (col *tcpInfoCollector) closing(c *countingConn) {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	if _, ok := col.conns[c]; !ok {
+		return
+	}
+	delete(col.conns, c)
+	col.read(c)
+}
+
+// finish reads the TCPInfo of the connections still open, and returns that of
+// every connection. Connections closed afterwards are ignored.
+func (col *tcpInfoCollector) finish() []TCPInfo {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	for c := range col.conns {
+		col.read(c)
+	}
+	col.conns = nil
+	col.finished = true
+	return col.infos
+}
+
+// read adds the TCPInfo of c, if it can be read. col.mu must be held.
+func (col *tcpInfoCollector) read(c *countingConn) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	if info, err := readTCPInfo(sc); err == nil {
+		col.infos = append(col.infos, *info)
+	}
+}
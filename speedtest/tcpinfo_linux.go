@@ -0,0 +1,111 @@
+//go:build linux && !386
+// +build linux,!386
+
+package speedtest
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// rawTCPInfo is the start of Linux's struct tcp_info, up to the fields
+// TCPInfo needs. Older kernels fill in less of it, leaving the rest zero.
+type rawTCPInfo struct {
+	state         uint8
+	caState       uint8
+	retransmits   uint8
+	probes        uint8
+	backoff       uint8
+	options       uint8
+	wscale        uint8
+	flags         uint8
+	rto           uint32
+	ato           uint32
+	sndMSS        uint32
+	rcvMSS        uint32
+	unacked       uint32
+	sacked        uint32
+	lost          uint32
+	retrans       uint32
+	fackets       uint32
+	lastDataSent  uint32
+	lastAckSent   uint32
+	lastDataRecv  uint32
+	lastAckRecv   uint32
+	pmtu          uint32
+	rcvSsthresh   uint32
+	rtt           uint32
+	rttvar        uint32
+	sndSsthresh   uint32
+	sndCwnd       uint32
+	advmss        uint32
+	reordering    uint32
+	rcvRTT        uint32
+	rcvSpace      uint32
+	totalRetrans  uint32
+	pacingRate    uint64
+	maxPacingRate uint64
+	bytesAcked    uint64
+	bytesReceived uint64
+	segsOut       uint32
+	segsIn        uint32
+	notsentBytes  uint32
+	minRTT        uint32
+	dataSegsIn    uint32
+	dataSegsOut   uint32
+	deliveryRate  uint64
+	busyTime      uint64
+	rwndLimited   uint64
+	sndbufLimited uint64
+	delivered     uint32
+	deliveredCE   uint32
+	bytesSent     uint64
+	bytesRetrans  uint64
+	dsackDups     uint32
+	reordSeen     uint32
+	rcvOoopack    uint32
+	sndWnd        uint32
+}
+
+// readTCPInfo asks the kernel for the state of conn's socket.
+func readTCPInfo(conn syscall.Conn) (*TCPInfo, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var info rawTCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(info))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = os.NewSyscallError("getsockopt", errno)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+
+	// the kernel reports times in microseconds and rates in bytes/sec.
+	usec := func(v uint64) time.Duration { return time.Duration(v) * time.Microsecond }
+	return &TCPInfo{
+		Retransmits:   info.totalRetrans,
+		RTT:           usec(uint64(info.rtt)),
+		RTTVar:        usec(uint64(info.rttvar)),
+		MinRTT:        usec(uint64(info.minRTT)),
+		Cwnd:          info.sndCwnd,
+		MSS:           info.sndMSS,
+		ReceiveWindow: info.sndWnd,
+		DeliveryRate:  Speed(info.deliveryRate * 8),
+		BusyTime:      usec(info.busyTime),
+		RwndLimited:   usec(info.rwndLimited),
+		SndbufLimited: usec(info.sndbufLimited),
+	}, nil
+}
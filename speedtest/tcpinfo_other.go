@@ -0,0 +1,13 @@
+//go:build !linux || 386
+// +build !linux 386
+
+package speedtest
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func readTCPInfo(conn syscall.Conn) (*TCPInfo, error) {
+	return nil, fmt.Errorf("TCP_INFO is only supported on Linux, except on 386")
+}
@@ -0,0 +1,143 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMaxHops = 30
+
+	// tracerouteProbes is the number of probes sent to each hop.
+	tracerouteProbes = 3
+
+	// traceroutePort is the first destination port probes are sent to. Each
+	// probe goes to the next port up, so that replies can be matched to
+	// probes, and the destination answers with port unreachable.
+	traceroutePort    = 33434
+	tracerouteTimeout = time.Second
+
+	// tracerouteDeadline bounds a whole traceroute, and the trace stops early
+	// after maxSilentHops hops in a row that don't answer, which is likely
+	// where the path drops the probes, so that a degraded test isn't
+	// followed by a long stall.
+	tracerouteDeadline = 20 * time.Second
+	maxSilentHops      = 4
+)
+
+// TracerouteConfig configures the traceroute run when a test fails or its
+// results fall below the thresholds given here.
+type TracerouteConfig struct {
+	// MinDownload and MinUpload are the slowest acceptable speeds. Zero
+	// means any speed is acceptable.
+	MinDownload Speed `json:"minDownload,omitempty"`
+	MinUpload   Speed `json:"minUpload,omitempty"`
+
+	// MaxPing is the highest acceptable median ping. Zero means any ping is
+	// acceptable.
+	MaxPing Duration `json:"maxPing,omitempty"`
+
+	// MaxHops is the TTL of the last probe. Zero means defaultMaxHops.
+	MaxHops int `json:"maxHops,omitempty"`
+
+	// TCP, if set, probes with TCP connection attempts to the server's own
+	// port, or 80 if its address has none, instead of UDP, for paths that
+	// drop UDP probes.
+	TCP bool `json:"tcp,omitempty"`
+}
+
+// Traceroute is the path to the server, captured because the test it is
+// attached to failed or was degraded.
+type Traceroute struct {
+	Target string
+
+	// Reason is why the traceroute was run.
+	Reason string
+
+	Hops []Hop
+}
+
+// Hop is a single TTL of a traceroute.
+type Hop struct {
+	TTL int
+
+	// Addr is the address that answered the hop's probes, or empty if none
+	// did.
+	Addr string
+
+	// RTTs holds the round trip time of each answered probe, and Lost counts
+	// the rest.
+	RTTs []time.Duration
+	Lost int
+}
+
+// String formats the traceroute much like the traceroute command, one hop
+// per line.
+func (t *Traceroute) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "traceroute to %s (%s)", t.Target, t.Reason)
+	for _, hop := range t.Hops {
+		fmt.Fprintf(&b, "\n%2d", hop.TTL)
+		if hop.Addr != "" {
+			fmt.Fprintf(&b, "  %s", hop.Addr)
+		}
+		for _, rtt := range hop.RTTs {
+			fmt.Fprintf(&b, "  %s", rtt)
+		}
+		for i := 0; i < hop.Lost; i++ {
+			b.WriteString("  *")
+		}
+	}
+	return b.String()
+}
+
+// degradedReason explains why result calls for a traceroute, or returns an
+// empty string if it doesn't.
+func degradedReason(result *Result, config *TracerouteConfig) string {
+	switch {
+	case result.Err != nil:
+		return fmt.Sprintf("failed: %s", result.Err)
+	case config.MinDownload > 0 && result.Ran(PhaseDownload) && result.DownloadSpeed < config.MinDownload:
+		return fmt.Sprintf("download %s below %s", result.DownloadSpeed, config.MinDownload)
+	case config.MinUpload > 0 && result.Ran(PhaseUpload) && result.UploadSpeed < config.MinUpload:
+		return fmt.Sprintf("upload %s below %s", result.UploadSpeed, config.MinUpload)
+	case config.MaxPing > 0 && result.Ran(PhasePing) && result.Ping > time.Duration(config.MaxPing):
+		return fmt.Sprintf("ping %s above %s", result.Ping, time.Duration(config.MaxPing))
+	default:
+		return ""
+	}
+}
+
+// runTraceroute traces the path to host, which may include a port. Once
+// tracerouteDeadline passes it returns the hops traced so far.
+func runTraceroute(ctx context.Context, d *dialer, host string, config *TracerouteConfig) ([]Hop, error) {
+	traceCtx, cancel := context.WithTimeout(ctx, tracerouteDeadline)
+	defer cancel()
+
+	ip, err := d.lookupIP(traceCtx, host)
+	if err != nil {
+		return nil, err
+	}
+	maxHops := config.MaxHops
+	if maxHops <= 0 {
+		maxHops = defaultMaxHops
+	}
+	tcpPort := 0
+	if config.TCP {
+		tcpPort = 80
+		if _, port, err := net.SplitHostPort(host); err == nil {
+			if tcpPort, err = strconv.Atoi(port); err != nil {
+				return nil, fmt.Errorf("invalid port in %q", host)
+			}
+		}
+	}
+	hops, err := traceroute(traceCtx, d, ip, maxHops, tcpPort)
+	if err != nil && ctx.Err() == nil && traceCtx.Err() != nil && len(hops) > 0 {
+		return hops, nil
+	}
+	return hops, err
+}
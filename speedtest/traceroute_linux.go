@@ -0,0 +1,401 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Fields of the errors the kernel queues for packets that couldn't be
+// delivered.
+const (
+	soEEOriginLocal = 1
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+
+	icmpTimeExceeded  = 11
+	icmp6TimeExceeded = 3
+
+	// sockExtendedErrSize is the size of struct sock_extended_err, which the
+	// offending router's address follows.
+	sockExtendedErrSize = 16
+)
+
+// traceroute sends UDP probes to ip with increasing TTLs, reading the ICMP
+// errors they cause from the socket's error queue, which unlike a raw socket
+// needs no privileges. If tcpPort is set, each probe is instead an attempt to
+// connect to that port, whose errors are queued the same way. If ctx is done
+// it returns the hops traced so far along with ctx's error.
+func traceroute(ctx context.Context, d *dialer, ip net.IP, maxHops, tcpPort int) ([]Hop, error) {
+	t := tracerFor(ip)
+	if tcpPort == 0 {
+		var err error
+		if t, err = newTracer(d, ip); err != nil {
+			return nil, err
+		}
+		defer syscall.Close(t.fd)
+	}
+
+	var hops []Hop
+	silent := 0
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if tcpPort == 0 {
+			if err := syscall.SetsockoptInt(t.fd, t.level, t.ttlOpt, ttl); err != nil {
+				return nil, err
+			}
+		}
+
+		hop := Hop{TTL: ttl}
+		reached := false
+		for i := 0; i < tracerouteProbes; i++ {
+			if ctx.Err() != nil {
+				return hops, ctx.Err()
+			}
+			var reply *probeReply
+			var err error
+			if tcpPort != 0 {
+				reply, err = t.probeTCP(d, tcpPort, ttl)
+			} else {
+				reply, err = t.probe(traceroutePort+(ttl-1)*tracerouteProbes+i, 0)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if reply == nil || reply.from == nil {
+				hop.Lost++
+				continue
+			}
+			hop.Addr = reply.from.String()
+			hop.RTTs = append(hop.RTTs, reply.rtt)
+			// anything but time exceeded, such as the destination's port
+			// unreachable or a router's host unreachable, ends the trace.
+			reached = reached || !reply.timeExceeded(t.v6)
+		}
+		hops = append(hops, hop)
+		if reached {
+			break
+		}
+		if hop.Addr != "" {
+			silent = 0
+		} else if silent++; silent == maxSilentHops {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// tracer is a UDP socket set up to receive ICMP errors on its error queue.
+type tracer struct {
+	fd      int
+	ip      net.IP
+	v6      bool
+	level   int
+	ttlOpt  int
+	recvErr int
+
+	// headerLen is the size of the IP and UDP headers of each probe.
+	headerLen int
+
+	// ipOffset and ipLen locate the address in the offender's sockaddr.
+	ipOffset int
+	ipLen    int
+}
+
+// tracerFor returns the socket options and address layout for tracing ip,
+// without opening a socket.
+func tracerFor(ip net.IP) *tracer {
+	t := &tracer{
+		ip:        ip,
+		level:     syscall.SOL_IP,
+		ttlOpt:    syscall.IP_TTL,
+		recvErr:   syscall.IP_RECVERR,
+		headerLen: 20 + 8,
+		ipOffset:  4,
+		ipLen:     net.IPv4len,
+	}
+	if ip.To4() == nil {
+		t.v6 = true
+		t.level = syscall.SOL_IPV6
+		t.ttlOpt = syscall.IPV6_UNICAST_HOPS
+		t.recvErr = syscall.IPV6_RECVERR
+		t.headerLen = 40 + 8
+		t.ipOffset = 8
+		t.ipLen = net.IPv6len
+	}
+	return t
+}
+
+func (t *tracer) family() int {
+	if t.v6 {
+		return syscall.AF_INET6
+	}
+	return syscall.AF_INET
+}
+
+// newTracer opens a UDP socket for tracing ip.
+func newTracer(d *dialer, ip net.IP) (*tracer, error) {
+	t := tracerFor(ip)
+	fd, err := syscall.Socket(t.family(), syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptInt(fd, t.level, t.recvErr, 1); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := d.bindFD(fd, t.v6); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	t.fd = fd
+	return t, nil
+}
+
+// probeReply is the error a probe caused.
+type probeReply struct {
+	// from is the address of the router or host that sent an ICMP error, or
+	// nil for errors raised locally.
+	from net.IP
+	rtt  time.Duration
+
+	origin   uint8
+	icmpType uint8
+	icmpCode uint8
+	errno    syscall.Errno
+
+	// info is the next hop MTU of "fragmentation needed" and "packet too
+	// big" errors.
+	info uint32
+}
+
+func (r *probeReply) timeExceeded(v6 bool) bool {
+	if v6 {
+		return r.origin == soEEOriginICMP6 && r.icmpType == icmp6TimeExceeded
+	}
+	return r.origin == soEEOriginICMP && r.icmpType == icmpTimeExceeded
+}
+
+// probe sends a probe of size bytes, including its headers, to port and
+// waits for the error it causes, returning nil if none arrived in time. A
+// size too small for the headers sends an empty probe.
+func (t *tracer) probe(port, size int) (*probeReply, error) {
+	var payload []byte
+	if size > t.headerLen {
+		payload = make([]byte, size-t.headerLen)
+	}
+
+	start := time.Now()
+	if err := syscall.Sendto(t.fd, payload, 0, t.sockaddr(port)); err != nil {
+		// an error for an earlier probe that timed out is reported by the
+		// next call on the socket, so ignore it and send again.
+		err = syscall.Sendto(t.fd, payload, 0, t.sockaddr(port))
+		if err == syscall.EMSGSIZE {
+			return &probeReply{origin: soEEOriginLocal, errno: syscall.EMSGSIZE}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	deadline := start.Add(tracerouteTimeout)
+	buf := make([]byte, 512)
+	oob := make([]byte, 512)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, nil
+		}
+		ready, err := waitReadable(t.fd, remaining)
+		if err != nil {
+			return nil, err
+		}
+		if !ready {
+			continue
+		}
+
+		_, oobn, _, to, err := syscall.Recvmsg(t.fd, buf, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		elapsed := time.Since(start)
+		if sockaddrPort(to) != port {
+			// a late reply to an earlier probe.
+			continue
+		}
+
+		if reply := t.parseError(oob[:oobn]); reply != nil {
+			reply.rtt = elapsed
+			return reply, nil
+		}
+	}
+}
+
+// probeTCP attempts a connection to port with the given TTL on a fresh socket
+// and waits for the error it causes, returning nil if nothing came back in
+// time. The connection being accepted or refused means the destination
+// answered.
+func (t *tracer) probeTCP(d *dialer, port, ttl int) (*probeReply, error) {
+	fd, err := syscall.Socket(t.family(), syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.SetsockoptInt(fd, t.level, t.recvErr, 1); err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptInt(fd, t.level, t.ttlOpt, ttl); err != nil {
+		return nil, err
+	}
+	if err := d.bindFD(fd, t.v6); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	err = syscall.Connect(fd, t.sockaddr(port))
+	if err == syscall.ECONNREFUSED {
+		return &probeReply{from: t.ip, rtt: time.Since(start)}, nil
+	}
+	if err != nil && err != syscall.EINPROGRESS {
+		return nil, err
+	}
+
+	deadline := start.Add(tracerouteTimeout)
+	buf := make([]byte, 512)
+	oob := make([]byte, 512)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, nil
+		}
+		ready, err := waitFD(fd, remaining, true)
+		if err != nil {
+			return nil, err
+		}
+		if !ready {
+			continue
+		}
+		elapsed := time.Since(start)
+
+		// an ICMP error from a router is queued as well as failing the
+		// connection, so look for it before asking how the attempt went.
+		_, oobn, _, _, err := syscall.Recvmsg(fd, buf, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+		if err == nil {
+			if reply := t.parseError(oob[:oobn]); reply != nil {
+				reply.rtt = elapsed
+				return reply, nil
+			}
+			continue
+		}
+		if err != syscall.EAGAIN && err != syscall.EINTR {
+			return nil, err
+		}
+
+		soErr, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if err != nil {
+			return nil, err
+		}
+		switch errno := syscall.Errno(soErr); errno {
+		case 0, syscall.ECONNREFUSED:
+			return &probeReply{from: t.ip, rtt: elapsed}, nil
+		default:
+			return &probeReply{origin: soEEOriginLocal, errno: errno, rtt: elapsed}, nil
+		}
+	}
+}
+
+// parseError finds the error in a message's control data.
+func (t *tracer) parseError(oob []byte) *probeReply {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		if int(msg.Header.Level) != t.level || int(msg.Header.Type) != t.recvErr {
+			continue
+		}
+		data := msg.Data
+		if len(data) < sockExtendedErrSize {
+			continue
+		}
+		reply := &probeReply{
+			errno:    syscall.Errno(nativeUint32(data[0:4])),
+			origin:   data[4],
+			icmpType: data[5],
+			icmpCode: data[6],
+			info:     nativeUint32(data[8:12]),
+		}
+		if reply.origin == soEEOriginLocal {
+			return reply
+		}
+		if reply.origin != soEEOriginICMP && reply.origin != soEEOriginICMP6 {
+			continue
+		}
+		if len(data) < sockExtendedErrSize+t.ipOffset+t.ipLen {
+			continue
+		}
+		offender := data[sockExtendedErrSize+t.ipOffset:]
+		reply.from = net.IP(append([]byte(nil), offender[:t.ipLen]...))
+		return reply
+	}
+	return nil
+}
+
+// nativeUint32 decodes a uint32 the kernel wrote in the host's byte order.
+func nativeUint32(b []byte) uint32 {
+	return *(*uint32)(unsafe.Pointer(&b[0]))
+}
+
+func (t *tracer) sockaddr(port int) syscall.Sockaddr {
+	if t.v6 {
+		sa := &syscall.SockaddrInet6{Port: port}
+		copy(sa.Addr[:], t.ip.To16())
+		return sa
+	}
+	sa := &syscall.SockaddrInet4{Port: port}
+	copy(sa.Addr[:], t.ip.To4())
+	return sa
+}
+
+func sockaddrPort(sa syscall.Sockaddr) int {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return sa.Port
+	case *syscall.SockaddrInet6:
+		return sa.Port
+	default:
+		return -1
+	}
+}
+
+// waitReadable waits up to timeout for fd to have something to read, which
+// includes a pending error.
+func waitReadable(fd int, timeout time.Duration) (bool, error) {
+	return waitFD(fd, timeout, false)
+}
+
+// waitFD waits up to timeout for fd to be readable, or writable too if write
+// is set, as a connecting socket becomes once it is connected.
+func waitFD(fd int, timeout time.Duration, write bool) (bool, error) {
+	var set syscall.FdSet
+	bits := int(8 * unsafe.Sizeof(set.Bits[0]))
+	if fd/bits >= len(set.Bits) {
+		return false, fmt.Errorf("file descriptor %d is too high to select on", fd)
+	}
+	set.Bits[fd/bits] |= 1 << uint(fd%bits)
+	var writeSet *syscall.FdSet
+	if write {
+		writeSet = &syscall.FdSet{Bits: set.Bits}
+	}
+	tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+	n, err := syscall.Select(fd+1, &set, writeSet, nil, &tv)
+	if err == syscall.EINTR {
+		return false, nil
+	}
+	return n > 0, err
+}
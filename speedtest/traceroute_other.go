@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+func traceroute(ctx context.Context, d *dialer, ip net.IP, maxHops, tcpPort int) ([]Hop, error) {
+	return nil, fmt.Errorf("traceroute is only supported on Linux")
+}
@@ -0,0 +1,214 @@
+package speedtest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer is the outcome of a download or upload measurement, which may have
+// been spread over several concurrent streams.
+type Transfer struct {
+	// Speed is the combined throughput of every stream.
+	Speed Speed
+
+	// Bytes is the number of bytes moved by every stream combined.
+	Bytes uint64
+
+	// Duration is the measured wall-clock window the streams shared, from
+	// when they started until the last one finished.
+	Duration time.Duration
+
+	// Streams holds the contribution of each individual stream.
+	Streams []StreamTransfer
+
+	// Samples breaks the transfer down into fixed intervals so that ramp up,
+	// stalls and oscillation within the test are visible.
+	Samples []Sample
+
+	// SteadySpeed is the combined throughput once the ramp up at the start of
+	// the test is over.
+	SteadySpeed Speed
+
+	// TCPInfo holds the kernel's view of each of the transfer's connections
+	// as it ended, on Linux.
+	TCPInfo []TCPInfo
+}
+
+// TransferOptions controls how a Backend runs a download or upload test.
+type TransferOptions struct {
+	// Duration is how long the test runs for.
+	Duration time.Duration
+
+	// Streams is the number of concurrent connections to use.
+	Streams int
+
+	// SampleInterval is the length of each of the Transfer's Samples.
+	SampleInterval time.Duration
+}
+
+// StreamTransfer is the contribution of a single stream to a Transfer.
+type StreamTransfer struct {
+	Speed Speed
+	Bytes uint64
+}
+
+// Sample is the data moved by every stream during one interval of a Transfer.
+type Sample struct {
+	// Offset is the end of the interval, measured from the start of the test.
+	Offset time.Duration
+	Speed  Speed
+	Bytes  uint64
+}
+
+// rampThreshold is the fraction of the late-test throughput a sample must
+// reach to be counted as past the ramp up.
+const rampThreshold = 0.8
+
+// streamFunc moves data over a single stream until deadline, atomically adding
+// the bytes it transfers to *n as it goes. It gives up once ctx is done.
+type streamFunc func(ctx context.Context, deadline time.Time, n *uint64) error
+
+// runStreams runs fn on opts.Streams goroutines at once and measures their
+// aggregate throughput over the window they share. The first stream to fail
+// stops the others, since its error throws the whole measurement away.
+func runStreams(ctx context.Context, opts TransferOptions, fn streamFunc) (*Transfer, error) {
+	streams := opts.Streams
+	if streams < 1 {
+		streams = 1
+	}
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	counts := make([]uint64, streams)
+	var failed sync.Once
+	var err error
+	total := func() uint64 {
+		var sum uint64
+		for i := range counts {
+			sum += atomic.LoadUint64(&counts[i])
+		}
+		return sum
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(opts.Duration)
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if streamErr := fn(streamCtx, deadline, &counts[i]); streamErr != nil {
+				failed.Do(func() {
+					err = streamErr
+					cancel()
+				})
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	sampled := make(chan []Sample)
+	go func() {
+		sampled <- sample(start, opts.SampleInterval, total, done)
+	}()
+
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(done)
+	samples := <-sampled
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Transfer{Duration: elapsed, Streams: make([]StreamTransfer, streams), Samples: samples}
+	for i := range counts {
+		n := atomic.LoadUint64(&counts[i])
+		t.Streams[i] = StreamTransfer{Speed: speed(n, elapsed), Bytes: n}
+		t.Bytes += n
+	}
+	t.Speed = speed(t.Bytes, elapsed)
+	t.SteadySpeed = steadySpeed(samples)
+	if t.SteadySpeed == 0 {
+		t.SteadySpeed = t.Speed
+	}
+
+	return t, nil
+}
+
+// sample records how far total advances every interval until done is closed,
+// finishing with a shorter sample for the remainder.
+func sample(start time.Time, interval time.Duration, total func() uint64, done <-chan struct{}) []Sample {
+	if interval <= 0 {
+		return nil
+	}
+
+	var samples []Sample
+	var last uint64
+	var lastOffset time.Duration
+	record := func(now time.Time) {
+		n := total()
+		offset := now.Sub(start)
+		samples = append(samples, Sample{
+			Offset: offset,
+			Speed:  speed(n-last, offset-lastOffset),
+			Bytes:  n - last,
+		})
+		last, lastOffset = n, offset
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			record(now)
+		case <-done:
+			record(time.Now())
+			return samples
+		}
+	}
+}
+
+// steadySpeed is the throughput over samples once the ramp up is over. The ramp
+// is taken to end at the first sample reaching rampThreshold of the throughput
+// over the second half of the test. It returns zero if there are too few
+// samples to tell.
+func steadySpeed(samples []Sample) Speed {
+	if len(samples) < 4 {
+		return 0
+	}
+
+	window := func(from int) (uint64, time.Duration) {
+		var bytes uint64
+		var start time.Duration
+		if from > 0 {
+			start = samples[from-1].Offset
+		}
+		for _, s := range samples[from:] {
+			bytes += s.Bytes
+		}
+		return bytes, samples[len(samples)-1].Offset - start
+	}
+
+	target := float64(speed(window(len(samples) / 2)))
+	for i, s := range samples {
+		if float64(s.Speed) >= rampThreshold*target {
+			return speed(window(i))
+		}
+	}
+	return 0
+}
+
+// speed converts a byte count moved over d into bits/sec.
+func speed(bytes uint64, d time.Duration) Speed {
+	if d <= 0 {
+		return 0
+	}
+	return Speed(float64(bytes*8) / d.Seconds())
+}
@@ -0,0 +1,111 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// samplesOf makes samples of the given bytes every 100ms.
+func samplesOf(bytes ...uint64) []Sample {
+	var samples []Sample
+	for i, b := range bytes {
+		samples = append(samples, Sample{
+			Offset: time.Duration(i+1) * 100 * time.Millisecond,
+			Speed:  speed(b, 100*time.Millisecond),
+			Bytes:  b,
+		})
+	}
+	return samples
+}
+
+func TestSteadySpeed(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []Sample
+		want    Speed
+	}{
+		{
+			name:    "too few samples",
+			samples: samplesOf(100, 100, 100),
+			want:    0,
+		},
+		{
+			name:    "flat",
+			samples: samplesOf(100, 100, 100, 100),
+			want:    8000,
+		},
+		{
+			name:    "ramp up is left out",
+			samples: samplesOf(10, 50, 100, 100, 100, 100, 100, 100),
+			want:    8000,
+		},
+		{
+			name:    "ramp ends at the threshold",
+			samples: samplesOf(10, 80, 100, 100),
+			want:    speed(280, 300*time.Millisecond),
+		},
+		{
+			name:    "nothing moved",
+			samples: samplesOf(0, 0, 0, 0),
+			want:    0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := steadySpeed(test.samples); got != test.want {
+				t.Errorf("steadySpeed = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunStreams(t *testing.T) {
+	opts := TransferOptions{Duration: 100 * time.Millisecond, Streams: 3}
+	got, err := runStreams(context.Background(), opts, func(ctx context.Context, deadline time.Time, n *uint64) error {
+		for time.Now().Before(deadline) {
+			atomic.AddUint64(n, 1000)
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Streams) != 3 {
+		t.Fatalf("got %d streams, want 3", len(got.Streams))
+	}
+	var sum uint64
+	for _, s := range got.Streams {
+		sum += s.Bytes
+	}
+	if sum != got.Bytes || got.Bytes == 0 {
+		t.Errorf("Bytes = %d, want the streams' total of %d", got.Bytes, sum)
+	}
+	if got.Duration < opts.Duration {
+		t.Errorf("Duration = %s, want at least %s", got.Duration, opts.Duration)
+	}
+}
+
+func TestRunStreamsFailureStopsTheOthers(t *testing.T) {
+	failed := errors.New("server busy")
+	var started int32
+	opts := TransferOptions{Duration: time.Minute, Streams: 3}
+	start := time.Now()
+	_, err := runStreams(context.Background(), opts, func(ctx context.Context, deadline time.Time, n *uint64) error {
+		if atomic.AddInt32(&started, 1) == 1 {
+			return failed
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != failed {
+		t.Errorf("err = %v, want %v", err, failed)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the other streams ran on for %s after one failed", elapsed)
+	}
+}
@@ -0,0 +1,219 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUDPCount      = 250
+	defaultUDPInterval   = 20 * time.Millisecond
+	defaultUDPPacketSize = 172
+
+	// udpMagic starts every probe packet, so that responders can ignore
+	// stray traffic.
+	udpMagic = "SDUP"
+
+	// udpHeaderSize is the size of a probe packet's header: the magic, the
+	// session, the sequence number, the send time and the number of packets
+	// the responder has received in the session. The rest is padding.
+	udpHeaderSize = 24
+)
+
+// UDPConfig configures the UDP probe, which sends a stream of small, evenly
+// spaced packets to a responder and measures how many come back, in what
+// order and how quickly, much like a VoIP call would experience the link.
+type UDPConfig struct {
+	// Server is the host:port of a UDP responder, such as one run with
+	// `speedtestdog serve -udpListen`.
+	Server string `json:"server"`
+
+	// Count is the number of packets sent in each test. Zero means
+	// defaultUDPCount.
+	Count int `json:"count,omitempty"`
+
+	// Interval is the time between packets. Zero means defaultUDPInterval,
+	// the frame interval of most VoIP codecs.
+	Interval Duration `json:"interval,omitempty"`
+
+	// PacketSize is the size of each packet's UDP payload. Zero means
+	// defaultUDPPacketSize, a 20ms G.711 frame with its RTP header.
+	PacketSize int `json:"packetSize,omitempty"`
+}
+
+// UDPResult is the outcome of a UDP probe.
+type UDPResult struct {
+	Sent     int
+	Received int
+
+	// Lost is the number of packets that never came back, and Loss is the
+	// percentage of Sent that they make up.
+	Lost int
+	Loss float64
+
+	// UpstreamLost and DownstreamLost split Lost by direction, going by how
+	// many packets the responder said it had received. Replies carrying the
+	// responder's count can themselves be lost, so the split is approximate.
+	UpstreamLost   int
+	DownstreamLost int
+
+	// Reordered is the number of packets that arrived after a later one, and
+	// Duplicates is the number of extra copies of packets that arrived.
+	Reordered  int
+	Duplicates int
+
+	// Latency holds the round trip time of every packet that came back, in
+	// the order they arrived, so that its Jitter is the packet delay
+	// variation.
+	Latency LatencyStats
+}
+
+// probeUDP runs a UDP probe against the responder configured in config.
+func probeUDP(ctx context.Context, config *UDPConfig, d *dialer) (*UDPResult, error) {
+	if config.Server == "" {
+		return nil, fmt.Errorf("the UDP probe needs a server to test against")
+	}
+	count := config.Count
+	if count <= 0 {
+		count = defaultUDPCount
+	}
+	interval := time.Duration(config.Interval)
+	if interval <= 0 {
+		interval = defaultUDPInterval
+	}
+	size := config.PacketSize
+	if size <= 0 {
+		size = defaultUDPPacketSize
+	}
+	if size < udpHeaderSize {
+		size = udpHeaderSize
+	}
+
+	conn, err := d.DialContext(ctx, "udp", config.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	var session [4]byte
+	if _, err := rand.Read(session[:]); err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	sentAt := make([]time.Time, count)
+	sent := 0
+	var sendErr error
+	sendDone := make(chan struct{})
+	go func() {
+		defer close(sendDone)
+		packet := make([]byte, size)
+		copy(packet, udpMagic)
+		copy(packet[4:8], session[:])
+		for i := 0; i < count; i++ {
+			delay := interval
+			if i == 0 {
+				delay = 0
+			}
+			if !wait(delay, ctx.Done()) {
+				return
+			}
+
+			now := time.Now()
+			binary.BigEndian.PutUint32(packet[8:12], uint32(i))
+			binary.BigEndian.PutUint64(packet[12:20], uint64(now.UnixNano()))
+			mu.Lock()
+			sentAt[i] = now
+			sent++
+			mu.Unlock()
+			if _, err := conn.Write(packet); err != nil {
+				mu.Lock()
+				sendErr = err
+				mu.Unlock()
+				return
+			}
+		}
+	}()
+
+	// wait for the last packet's reply for as long as a ping would.
+	deadline := time.Now().Add(time.Duration(count-1)*interval + pingTimeout)
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	var samples []time.Duration
+	seen := make([]bool, count)
+	received, highest := 0, -1
+	var serverReceived uint32
+	result := &UDPResult{}
+	buf := make([]byte, size+1)
+	for received < count {
+		n, err := conn.Read(buf)
+		if isTimeout(err) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			<-sendDone
+			return nil, err
+		}
+		now := time.Now()
+		if n < udpHeaderSize || string(buf[:4]) != udpMagic || string(buf[4:8]) != string(session[:]) {
+			continue
+		}
+		seq := int(binary.BigEndian.Uint32(buf[8:12]))
+		if seq >= count {
+			continue
+		}
+		if seen[seq] {
+			result.Duplicates++
+			continue
+		}
+		seen[seq] = true
+		received++
+		if seq < highest {
+			result.Reordered++
+		} else {
+			highest = seq
+		}
+		if c := binary.BigEndian.Uint32(buf[20:24]); c > serverReceived {
+			serverReceived = c
+		}
+
+		mu.Lock()
+		samples = append(samples, now.Sub(sentAt[seq]))
+		mu.Unlock()
+	}
+	<-sendDone
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if sendErr != nil {
+		return nil, sendErr
+	}
+
+	result.Sent = sent
+	result.Received = received
+	result.Lost = sent - received
+	if sent > 0 {
+		result.Loss = 100 * float64(result.Lost) / float64(sent)
+	}
+	result.UpstreamLost = sent - int(serverReceived)
+	if result.UpstreamLost < 0 {
+		result.UpstreamLost = 0
+	}
+	if result.UpstreamLost > result.Lost {
+		result.UpstreamLost = result.Lost
+	}
+	result.DownstreamLost = result.Lost - result.UpstreamLost
+	result.Latency = newLatencyStats(samples, result.Lost)
+	return result, nil
+}
@@ -0,0 +1,83 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// udpSessionTimeout is how long a UDP probe session is remembered after its
+// last packet.
+const udpSessionTimeout = time.Minute
+
+// UDPServer echoes the packets of UDP probes back to the agents sending them,
+// along with how many packets of each probe it has received, so that agents
+// can tell which direction lost the rest.
+type UDPServer struct {
+	// Addr is the UDP address to listen on, such as ":8081".
+	Addr string
+}
+
+// udpSession tracks a single probe, identified by its sender and session.
+type udpSession struct {
+	received uint32
+	last     time.Time
+}
+
+// ListenAndServe listens on s.Addr and answers probes until ctx is done.
+func (s *UDPServer) ListenAndServe(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, conn)
+}
+
+// Serve answers probes received on conn until ctx is done, and then closes
+// conn.
+func (s *UDPServer) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	sessions := make(map[string]*udpSession)
+	lastSweep := time.Now()
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n < udpHeaderSize || string(buf[:4]) != udpMagic {
+			continue
+		}
+
+		now := time.Now()
+		if now.Sub(lastSweep) > udpSessionTimeout {
+			for key, session := range sessions {
+				if now.Sub(session.last) > udpSessionTimeout {
+					delete(sessions, key)
+				}
+			}
+			lastSweep = now
+		}
+
+		key := addr.String() + "/" + string(buf[4:8])
+		session, ok := sessions[key]
+		if !ok {
+			session = &udpSession{}
+			sessions[key] = session
+		}
+		session.received++
+		session.last = now
+
+		binary.BigEndian.PutUint32(buf[20:24], session.received)
+		// a reply that can't be sent is just another lost packet.
+		conn.WriteTo(buf[:n], addr)
+	}
+}
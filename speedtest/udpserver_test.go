@@ -0,0 +1,134 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// serveUDPTest starts a UDPServer on a loopback port until the test ends, and
+// returns its address.
+func serveUDPTest(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go (&UDPServer{}).Serve(ctx, conn)
+	return conn.LocalAddr().String()
+}
+
+// udpRelay forwards probe packets between a client and server, passing each
+// through up or down, which return the packets to forward in its place.
+func udpRelay(t *testing.T, server string, up, down func(seq int, packet []byte) [][]byte) string {
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := net.Dial("udp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		upstream.Close()
+	})
+
+	seq := func(packet []byte) int { return int(binary.BigEndian.Uint32(packet[8:12])) }
+	from := make(chan net.Addr, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := client.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case from <- addr:
+			default:
+			}
+			for _, p := range up(seq(buf[:n]), buf[:n]) {
+				upstream.Write(p)
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 64*1024)
+		addr := <-from
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			packet := append([]byte(nil), buf[:n]...)
+			for _, p := range down(seq(packet), packet) {
+				client.WriteTo(p, addr)
+			}
+		}
+	}()
+	return client.LocalAddr().String()
+}
+
+func TestUDPServerRoundTrip(t *testing.T) {
+	config := &UDPConfig{Server: serveUDPTest(t), Count: 20, Interval: Duration(time.Millisecond)}
+	got, err := probeUDP(context.Background(), config, &dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Sent != 20 || got.Received != 20 || got.Lost != 0 || got.Reordered != 0 || got.Duplicates != 0 {
+		t.Errorf("probeUDP = %+v, want all 20 back in order", got)
+	}
+	if len(got.Latency.Samples) != 20 {
+		t.Errorf("got %d latency samples, want 20", len(got.Latency.Samples))
+	}
+}
+
+func TestUDPServerLossAndReordering(t *testing.T) {
+	pass := func(seq int, p []byte) [][]byte { return [][]byte{p} }
+	var held []byte
+	relay := udpRelay(t, serveUDPTest(t),
+		func(seq int, p []byte) [][]byte {
+			if seq == 3 || seq == 4 {
+				return nil
+			}
+			return pass(seq, p)
+		},
+		func(seq int, p []byte) [][]byte {
+			switch seq {
+			case 1:
+				held = p
+				return nil
+			case 2:
+				return [][]byte{p, held}
+			case 5:
+				return [][]byte{p, p}
+			case 7:
+				return nil
+			}
+			return pass(seq, p)
+		})
+
+	config := &UDPConfig{Server: relay, Count: 10, Interval: Duration(5 * time.Millisecond)}
+	got, err := probeUDP(context.Background(), config, &dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := UDPResult{
+		Sent:           10,
+		Received:       7,
+		Lost:           3,
+		Loss:           30,
+		UpstreamLost:   2,
+		DownstreamLost: 1,
+		Reordered:      1,
+		Duplicates:     1,
+	}
+	got.Latency = LatencyStats{}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("probeUDP = %+v, want %+v", *got, want)
+	}
+}